@@ -1,11 +1,13 @@
 package blobstore
 
 import (
+	"github.com/cinode/golib/cipherfactory"
 	"io"
 )
 
 type baseBlobReader struct {
-	storage BlobStorage // Blob storage
+	storage BlobStorage           // Blob storage
+	cf      cipherfactory.Factory // Cipher factory, default one is used if nil
 }
 
 // Internal function, try to open a blob having it's bid and key,
@@ -32,7 +34,7 @@ func (r *baseBlobReader) openInternal(
 	}
 
 	// Get the unencrypted stream
-	if reader, err = createReaderForHashBlobData(reader, bid, key); err != nil {
+	if reader, err = createReaderForHashBlobData(reader, bid, key, r.cf); err != nil {
 		return
 	}
 
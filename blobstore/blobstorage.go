@@ -27,6 +27,17 @@ type WriteFinalizeCanceler interface {
 	Cancel() error
 }
 
+// Writer for blobs whose id is known once all the data is written
+type DeferredBlobWriter interface {
+	io.Writer
+
+	// Finalize blob generation storing it under given id
+	Finalize(blobId string) error
+
+	// Cancel the blob generation
+	Cancel() error
+}
+
 // An interface usefull for blob storage operations
 type BlobStorage interface {
 
@@ -36,3 +47,12 @@ type BlobStorage interface {
 	// Create new reader for existing blob
 	NewBlobReader(blobId string) (reader io.Reader, err error)
 }
+
+// Blob storage that can accept blob data before the blob id is known,
+// blobs written to such storage don't have to be buffered before writing
+type DeferredBlobStorage interface {
+	BlobStorage
+
+	// Create new writer for blob with the id given on finalization
+	NewDeferredBlobWriter() (writer DeferredBlobWriter, err error)
+}
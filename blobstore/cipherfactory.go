@@ -1,102 +1,69 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
 package blobstore
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/sha512"
-	"encoding/hex"
-	"errors"
-	"io"
-)
-
-var (
-	ErrInsufficientKeySource = errors.New("Not enough data to create a proper encryption key")
-	ErrInvalidKey            = errors.New("Invalid key")
-	ErrUnknownKeyType        = errors.New("Unknown key type")
+	"github.com/cinode/golib/cipherfactory"
+	"hash"
 )
 
-func createEncryptor(keySource, ivSource []byte, output io.Writer) (writer io.Writer, key string, err error) {
-
-	// Need at least 32 bytes of the key source
-	if len(keySource) < 32 {
-		err = ErrInsufficientKeySource
-		return
-	}
-
-	// Create the iv
-	var iv [16]byte
-	for i, b := range ivSource {
-		iv[i] = b
-		if i >= 15 {
-			break
-		}
+// Get the cipher factory to use, the default one is returned if none is given
+func getCipherFactory(cf cipherfactory.Factory) cipherfactory.Factory {
+	if cf == nil {
+		return cipherfactory.Create()
 	}
+	return cf
+}
 
-	keyRaw := keySource[:32]
-	key = cipherAES256Hex + hex.EncodeToString(keyRaw)
-
-	// Generate the encrypted content
-	blobCipher, err := aes.NewCipher(keyRaw)
+// Calculate the hash of the data using the hasher provided by the cipher factory
+func createDataHash(cf cipherfactory.Factory, data []byte) ([]byte, error) {
+	hasher, err := cf.CreateHasher()
 	if err != nil {
-		return
+		return nil, err
 	}
-
-	// Generate the writer
-	writer = &cipher.StreamWriter{
-		S: cipher.NewCFBEncrypter(
-			blobCipher,
-			iv[:]),
-		W: output}
-
-	return
+	hasher.Write(data)
+	return hasher.Sum(nil), nil
 }
 
-func createDecryptor(key string, ivSource []byte, input io.Reader) (reader io.Reader, err error) {
-	keyRaw, err := hex.DecodeString(key)
-	if err != nil || len(keyRaw) < 1 {
-		return nil, ErrInvalidKey
-	}
+// Create the hasher used to derive the encryption key from the content.
+//
+// Without the convergence secret the key is the plain hash of the content,
+// anyone knowing the content can then confirm it's in the store. With the
+// secret, HMAC of the content is used instead - data is still deduplicated
+// among writers sharing the secret but can't be confirmed by outsiders.
+func createKeySourceHasher(cf cipherfactory.Factory, convergenceSecret []byte) (hash.Hash, error) {
 
-	switch keyRaw[0] {
-	case cipherAES256:
-		return createDecryptorAES256(keyRaw[1:], ivSource, input)
+	hasher, err := cf.CreateHasher()
+	if err != nil {
+		return nil, err
 	}
-
-	return nil, ErrUnknownKeyType
-}
-
-func createDecryptorAES256(key []byte, ivSource []byte, input io.Reader) (reader io.Reader, err error) {
-
-	if len(key) != 32 {
-		return nil, ErrInvalidKey
+	if len(convergenceSecret) == 0 {
+		return hasher, nil
 	}
 
-	// Normalize the iv
-	var iv [16]byte
-	for i, b := range ivSource {
-		iv[i] = b
-		if i >= 15 {
-			break
+	// HMAC needs separate inner and outer hashers, the one created above
+	// is used first. Failures of further ones are reported once HMAC is
+	// built, a placeholder keeps it constructible until then.
+	var hasherErr error
+	mac := hmac.New(func() hash.Hash {
+		if h := hasher; h != nil {
+			hasher = nil
+			return h
 		}
+		h, err := cf.CreateHasher()
+		if err != nil {
+			hasherErr = err
+			return sha512.New()
+		}
+		return h
+	}, convergenceSecret)
+	if hasherErr != nil {
+		return nil, hasherErr
 	}
 
-	// Create new base cipher
-	blobCipher, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-
-	// Generate the reader in CFB mode
-	return &cipher.StreamReader{
-			S: cipher.NewCFBDecrypter(
-				blobCipher,
-				iv[:]),
-			R: input},
-		nil
-}
-
-func createDataHash(data []byte) []byte {
-	hasher := sha512.New()
-	hasher.Write(data)
-	return hasher.Sum(nil)
+	return mac, nil
 }
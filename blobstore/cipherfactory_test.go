@@ -0,0 +1,358 @@
+package blobstore
+
+import (
+	"bytes"
+	"errors"
+	"github.com/cinode/golib/cipherfactory"
+	"hash"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// Cipher factory counting calls to the default one
+type countingFactory struct {
+	cipherfactory.Factory
+	encryptors, decryptors, hashers int
+}
+
+func (c *countingFactory) CreateEncryptor(keySource, ivSource []byte, output io.Writer) (io.Writer, string, error) {
+	c.encryptors++
+	return c.Factory.CreateEncryptor(keySource, ivSource, output)
+}
+
+func (c *countingFactory) CreateDecryptor(key string, ivSource []byte, input io.Reader) (io.Reader, error) {
+	c.decryptors++
+	return c.Factory.CreateDecryptor(key, ivSource, input)
+}
+
+func (c *countingFactory) CreateHasher() (hash.Hash, error) {
+	c.hashers++
+	return c.Factory.CreateHasher()
+}
+
+func TestCustomCipherFactory(t *testing.T) {
+
+	cf := &countingFactory{Factory: cipherfactory.Create()}
+	m := NewMemoryBlobStorage()
+
+	fw := FileBlobWriter{Storage: m, CipherFactory: cf}
+	fw.Write([]byte("Hello World!"))
+	bid, key, err := fw.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dw := DirBlobWriter{Storage: m, CipherFactory: cf}
+	dw.AddEntry(DirEntry{Name: "hello.txt", MimeType: "text/plain", Bid: bid, Key: key})
+	dirBid, dirKey, err := dw.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cf.encryptors != 2 || cf.hashers == 0 {
+		t.Fatalf("Custom cipher factory not used by writers")
+	}
+
+	dr := NewDirBlobReaderWithFactory(m, cf)
+	if err = dr.Open(dirBid, dirKey); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := dr.NextEntry()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr := NewFileBlobReaderWithFactory(m, cf)
+	if err = fr.Open(entry.Bid, entry.Key); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("Hello World!")) {
+		t.Fatal("Invalid data read")
+	}
+
+	if cf.decryptors != 2 {
+		t.Fatalf("Custom cipher factory not used by readers")
+	}
+}
+
+func TestAuthenticatedCipherFileBlob(t *testing.T) {
+
+	cf, err := cipherfactory.CreateForCipher(cipherfactory.CipherAES256GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMemoryBlobStorage()
+
+	fw := FileBlobWriter{Storage: m, CipherFactory: cf}
+	fw.Write([]byte("Hello World!"))
+	bid, key, err := fw.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Default reader must handle any supported key type
+	fr := NewFileBlobReader(m)
+	if err = fr.Open(bid, key); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("Hello World!")) {
+		t.Fatal("Invalid data read")
+	}
+}
+
+func benchmarkFileBlobWriter(b *testing.B, cipherType int) {
+
+	cf, err := cipherfactory.CreateForCipher(cipherType)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	const size = 2*maxSimpleFileDataSize + 1024*1024
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fw := FileBlobWriter{Storage: NewMemoryBlobStorage(), CipherFactory: cf}
+		for written := 0; written < size; written += len(data) {
+			fw.Write(data)
+		}
+		if _, _, err := fw.Finalize(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFileBlobWriterAES256CFB(b *testing.B) {
+	benchmarkFileBlobWriter(b, cipherfactory.CipherAES256CFB)
+}
+
+func BenchmarkFileBlobWriterAES256GCM(b *testing.B) {
+	benchmarkFileBlobWriter(b, cipherfactory.CipherAES256GCM)
+}
+
+func TestMixedHashGenerations(t *testing.T) {
+
+	m := NewMemoryBlobStorage()
+	dw := DirBlobWriter{Storage: m}
+
+	for _, hashType := range []int{cipherfactory.HashSHA512, cipherfactory.HashSHA256, cipherfactory.HashBLAKE2b512} {
+		fw := FileBlobWriter{Storage: m, CipherFactory: cipherfactory.Create(cipherfactory.WithHash(hashType))}
+		fw.Write([]byte("Hello World!"))
+		bid, key, err := fw.Finalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dw.AddEntry(DirEntry{Name: bid, Bid: bid, Key: key})
+	}
+
+	dirBid, dirKey, err := dw.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readDirEntries(t, m, dirBid, dirKey)
+	if len(entries) != 3 {
+		t.Fatal("Blobs with different hash types must have different bids")
+	}
+	for _, entry := range entries {
+		fr := NewFileBlobReader(m)
+		if err = fr.Open(entry.Bid, entry.Key); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, []byte("Hello World!")) {
+			t.Fatal("Invalid data read")
+		}
+	}
+}
+
+// Cipher factory failing to create hashers after given number of them
+type failingHasherFactory struct {
+	cipherfactory.Factory
+	hashers int
+}
+
+func (f *failingHasherFactory) CreateHasher() (hash.Hash, error) {
+	if f.hashers == 0 {
+		return nil, errors.New("Hasher not available")
+	}
+	f.hashers--
+	return f.Factory.CreateHasher()
+}
+
+func TestKeySourceHasherErrors(t *testing.T) {
+
+	for hashers := 0; hashers < 2; hashers++ {
+		cf := &failingHasherFactory{Factory: cipherfactory.Create(), hashers: hashers}
+		if _, err := createKeySourceHasher(cf, []byte("secret")); err == nil {
+			t.Fatalf("Hasher error not reported with %v hashers available", hashers)
+		}
+	}
+
+	cf := &failingHasherFactory{Factory: cipherfactory.Create(), hashers: 2}
+	if _, err := createKeySourceHasher(cf, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConvergenceSecret(t *testing.T) {
+
+	m := NewMemoryBlobStorage()
+
+	write := func(secret string) (string, string) {
+		fw := FileBlobWriter{Storage: m, ConvergenceSecret: []byte(secret)}
+		fw.Write([]byte("Hello World!"))
+		bid, key, err := fw.Finalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bid, key
+	}
+
+	bidPlain, keyPlain := write("")
+	bidA1, keyA1 := write("tenant A")
+	bidA2, keyA2 := write("tenant A")
+	bidB, keyB := write("tenant B")
+
+	if bidA1 != bidA2 || keyA1 != keyA2 {
+		t.Fatal("Blobs not deduplicated for the same convergence secret")
+	}
+	if bidA1 == bidPlain || keyA1 == keyPlain || bidA1 == bidB || keyA1 == keyB {
+		t.Fatal("Blobs with different convergence secrets must differ")
+	}
+
+	// No secret must give the legacy blob
+	if bidPlain != "82aeef202165cf11930ea44a9ad8337aea355d63751a7260552e3e014ad6313bca69c83fa4e3555531d44a1025708183784af0e2002562b7260559ce0e7af262" {
+		t.Fatal("Invalid blob generated without convergence secret")
+	}
+
+	// Reader needs the key only
+	fr := NewFileBlobReader(m)
+	if err := fr.Open(bidB, keyB); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("Hello World!")) {
+		t.Fatal("Invalid data read")
+	}
+}
+
+func TestTreeCustomCipherFactory(t *testing.T) {
+
+	cf := &countingFactory{Factory: cipherfactory.Create()}
+	opts := &TreeOptions{CipherFactory: cf}
+	m := NewMemoryBlobStorage()
+
+	base, baseKey, err := UpdateTree(m, "", "", []TreeOp{
+		{Type: TreeOpPut, Path: "a/b/f1", Entry: fileEntry("f1")},
+	}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ours, oursKey, err := UpdateTree(m, base, baseKey, []TreeOp{
+		{Type: TreeOpPut, Path: "a/b/f2", Entry: fileEntry("f2")},
+	}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, theirsKey, err := UpdateTree(m, base, baseKey, []TreeOp{
+		{Type: TreeOpPut, Path: "a/f3", Entry: fileEntry("f3")},
+	}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.encryptors == 0 || cf.decryptors == 0 {
+		t.Fatal("Custom cipher factory not used by the tree editor")
+	}
+
+	// Both roots and both versions of nested directories "a" and "a/b"
+	cf.encryptors, cf.decryptors = 0, 0
+	d := NewTreeDiff(m, base, baseKey, ours, oursKey, opts)
+	for d.IsNextChange() {
+		if _, err = d.NextChange(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cf.decryptors != 6 {
+		t.Fatalf("Custom cipher factory not used by the tree diff, decryptors: %v", cf.decryptors)
+	}
+
+	// Directories "a" changed on both sides are loaded once, together with the roots
+	cf.encryptors, cf.decryptors = 0, 0
+	if _, _, _, err = MergeTrees(m, base, baseKey, ours, oursKey, theirs, theirsKey, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	if cf.encryptors == 0 || cf.decryptors != 6 {
+		t.Fatalf("Custom cipher factory not used by the tree merge, decryptors: %v", cf.decryptors)
+	}
+}
+
+func TestCipherErrorsCompatibility(t *testing.T) {
+	if ErrInvalidKey != cipherfactory.ErrInvalidKey ||
+		ErrInsufficientKeySource != cipherfactory.ErrInsufficientKeySource ||
+		ErrUnknownKeyType != cipherfactory.ErrUnknownKeyType {
+		t.Fatal("Cipher errors must be the same as in the cipherfactory package")
+	}
+}
+
+func TestTreeConvergenceSecret(t *testing.T) {
+
+	m := NewMemoryBlobStorage()
+	secret := &TreeOptions{ConvergenceSecret: []byte("tenant A")}
+
+	update := func(bid, key string, opts *TreeOptions, ops ...TreeOp) (string, string) {
+		bid, key, err := UpdateTree(m, bid, key, ops, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bid, key
+	}
+	put1 := TreeOp{Type: TreeOpPut, Path: "a/f1", Entry: fileEntry("f1")}
+	put2 := TreeOp{Type: TreeOpPut, Path: "a/f2", Entry: fileEntry("f2")}
+
+	plain, _ := update("", "", nil, put1)
+	base, baseKey := update("", "", secret, put1)
+	if plain == base {
+		t.Fatal("Convergence secret not used by UpdateTree")
+	}
+
+	// Merged tree must be the same as the one written directly
+	ours, oursKey := update(base, baseKey, secret, put2)
+	theirs, theirsKey := update(base, baseKey, secret, TreeOp{Type: TreeOpMkdir, Path: "b"})
+	expected, _ := update(ours, oursKey, secret, TreeOp{Type: TreeOpMkdir, Path: "b"})
+
+	merged, _, _, err := MergeTrees(m, base, baseKey, ours, oursKey, theirs, theirsKey, nil, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged != expected {
+		t.Fatal("Convergence secret not used by MergeTrees")
+	}
+
+	mergedPlain, _, _, err := MergeTrees(m, base, baseKey, ours, oursKey, theirs, theirsKey, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mergedPlain == merged {
+		t.Fatal("Merged trees with different convergence secrets must differ")
+	}
+}
@@ -5,25 +5,35 @@
 package blobstore
 
 const (
-	blobTypeSimpleStaticFile = 0x01
-	blobTypeSplitStaticFile  = 0x02
-	blobTypeSimpleStaticDir  = 0x11
-	blobTypeSplitStaticDir   = 0x12
-
-	cipherAES256    = 0x01
-	cipherAES256Hex = "01"
+	blobTypeSimpleStaticFile  = 0x01
+	blobTypeSplitStaticFile   = 0x02
+	blobTypeSimpleStaticDir   = 0x11
+	blobTypeSplitStaticDir    = 0x12
+	blobTypeSimpleStaticDirV2 = 0x13
 
 	maxSimpleFileDataSize = 16 * 1024 * 1024
 	maxSimpleDirEntries   = 1024
 
+	maxSpoolMemorySize = 256 * 1024
+
 	maxSaneSplitFileParts  = 1024 * 1024
 	maxSaneBidLength       = 1024
 	maxSaneKeyLength       = 16 * 1024
 	maxSaneNameLenght      = 1024
 	maxSaneMimeTypeLength  = 128
 	maxSanePubKeyLength    = 32 * 1024
+	maxSanePrivKeyLength   = 32 * 1024
 	maxSaneSignatureLength = 1024
 
-	validationMethodHash = 0x01
-	validationMethodSign = 0x02
+	maxSaneDirEntryAttributes   = 256
+	maxSaneAttributeNameLength  = 256
+	maxSaneAttributeValueLength = 16 * 1024
+
+	validationMethodHash   = 0x01
+	validationMethodSign   = 0x02 // Signed blob using the version as IV
+	validationMethodSignV2 = 0x03 // Signed blob with random nonce stored in the header
+
+	signedBlobNonceLength = 24
+
+	signedBlobKeysVersion = 0x01
 )
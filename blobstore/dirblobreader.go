@@ -1,6 +1,7 @@
 package blobstore
 
 import (
+	"github.com/cinode/golib/cipherfactory"
 	"io"
 )
 
@@ -19,13 +20,20 @@ type dirBlobReader struct {
 	baseBlobReader             // Inherit methods of base blob reader
 	Storage        BlobStorage // Blob storage
 	currentReader  io.Reader   // Current reader we work on
-	entriesLeft    int64       // Number of directory entries left to read   
+	entriesLeft    int64       // Number of directory entries left to read
+	extended       bool        // Flag indicating whether entries are in the versioned format
 }
 
 func NewDirBlobReader(storage BlobStorage) DirBlobReader {
+	return NewDirBlobReaderWithFactory(storage, nil)
+}
+
+// Create directory blob reader using given cipher factory
+func NewDirBlobReaderWithFactory(storage BlobStorage, cf cipherfactory.Factory) DirBlobReader {
 	return &dirBlobReader{
 		baseBlobReader: baseBlobReader{
-			storage: storage}}
+			storage: storage,
+			cf:      cf}}
 }
 
 func (d *dirBlobReader) Open(bid, key string) error {
@@ -39,8 +47,9 @@ func (d *dirBlobReader) Open(bid, key string) error {
 	// Validate the blob type
 	switch blobType {
 
-	case blobTypeSimpleStaticDir:
+	case blobTypeSimpleStaticDir, blobTypeSimpleStaticDirV2:
 		d.currentReader = reader
+		d.extended = blobType == blobTypeSimpleStaticDirV2
 		if d.entriesLeft, err = deserializeInt(reader); err != nil {
 			return err
 		}
@@ -76,7 +85,12 @@ func (d *dirBlobReader) NextEntry() (entry DirEntry, err error) {
 	d.entriesLeft--
 
 	// Read one entry
-	if err = entry.deserialize(d.currentReader); err != nil {
+	if d.extended {
+		err = entry.deserializeV2(d.currentReader)
+	} else {
+		err = entry.deserialize(d.currentReader)
+	}
+	if err != nil {
 		return
 	}
 
@@ -97,3 +111,49 @@ func (d *dirBlobReader) atEOF() bool {
 	// TODO: We're using this for validation only, implement the proper version
 	return true
 }
+
+// Read all entries of the directory the given entry points to, entries
+// of unknown kind are treated as directories if they open as such.
+// ErrNotADirectory is returned for entries pointing to other blobs.
+func loadDirEntries(storage BlobStorage, cf cipherfactory.Factory, dir *DirEntry) (entries []DirEntry, err error) {
+
+	switch dir.Kind {
+	case EntryKindDir, EntryKindUnknown:
+	default:
+		return nil, ErrNotADirectory
+	}
+
+	reader := NewDirBlobReaderWithFactory(storage, cf)
+	if err = reader.Open(dir.Bid, dir.Key); err != nil {
+		if err == ErrInvalidFileBlobType {
+			return nil, ErrNotADirectory
+		}
+		return nil, err
+	}
+
+	for reader.IsNextEntry() {
+		entry, err := reader.NextEntry()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Similar to loadDirEntries but does report whether the entry is a directory
+// instead of failing for non-directory entries
+func probeDirEntries(storage BlobStorage, cf cipherfactory.Factory, entry *DirEntry) (entries []DirEntry, isDir bool, err error) {
+	if entry.Kind != EntryKindDir && entry.Kind != EntryKindUnknown {
+		return nil, false, nil
+	}
+	entries, err = loadDirEntries(storage, cf, entry)
+	if err == ErrNotADirectory && entry.Kind == EntryKindUnknown {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return entries, true, nil
+}
@@ -2,6 +2,7 @@ package blobstore
 
 import (
 	"testing"
+	"time"
 )
 
 func genTestDirData() (BlobStorage, *DirBlobWriter, DirBlobReader) {
@@ -51,7 +52,7 @@ func testMultipleEntriesDir(t *testing.T, entries []DirEntry) {
 			t.Error("Read unknown entry: " + entry.Name)
 		}
 
-		if entry != entry2 {
+		if !entry.Equal(&entry2) {
 			t.Error("Entries do not match: " + entry.Name)
 		}
 
@@ -88,6 +89,18 @@ var testVector = [][]DirEntry{
 		{Name: "test.txt", MimeType: "mime", Key: "key", Bid: "bid"},
 		{Name: "test4.txt", MimeType: "mime4", Key: "key4", Bid: "bid4"},
 	},
+	// Extended metadata
+	{
+		{Name: "dir", Bid: "bid", Key: "key", Kind: EntryKindDir, Mode: 0755},
+		{Name: "file.txt", MimeType: "text/plain", Bid: "bid2", Key: "key2",
+			Kind: EntryKindFile, Size: 1234, Mode: 0644,
+			ModTime: time.Date(2013, 11, 27, 13, 45, 12, 12345, time.UTC)},
+		{Name: "old", Bid: "bid3", Key: "key3", Kind: EntryKindFile,
+			ModTime: time.Date(1901, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Name: "link", Bid: "bid4", Key: "key4", Kind: EntryKindSymlink,
+			Attributes: NewEntryAttributes(map[string]string{"owner": "root", "group": "wheel"})},
+		{Name: "legacy", Bid: "bid5", Key: "key5"},
+	},
 }
 
 func TestDirVectors(t *testing.T) {
@@ -95,3 +108,69 @@ func TestDirVectors(t *testing.T) {
 		testMultipleEntriesDir(t, data)
 	}
 }
+
+func TestDirFormatVersion(t *testing.T) {
+
+	for _, data := range []struct {
+		entry    DirEntry
+		blobType int64
+	}{
+		{DirEntry{Name: "a", Bid: "bid", Key: "key"}, blobTypeSimpleStaticDir},
+		{DirEntry{Name: "a", Bid: "bid", Key: "key", Kind: EntryKindFile}, blobTypeSimpleStaticDirV2},
+		{DirEntry{Name: "a", Bid: "bid", Key: "key", Size: 1}, blobTypeSimpleStaticDirV2},
+		{DirEntry{Name: "a", Bid: "bid", Key: "key", Mode: 0600}, blobTypeSimpleStaticDirV2},
+		{DirEntry{Name: "a", Bid: "bid", Key: "key", ModTime: time.Unix(1, 0)}, blobTypeSimpleStaticDirV2},
+		{DirEntry{Name: "a", Bid: "bid", Key: "key", Attributes: NewEntryAttributes(map[string]string{"a": "b"})}, blobTypeSimpleStaticDirV2},
+	} {
+		storage, w, _ := genTestDirData()
+		w.AddEntry(data.entry)
+
+		bid, key, err := w.Finalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		base := baseBlobReader{storage: storage}
+		_, blobType, err := base.openInternal(bid, key, validationMethodHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blobType != data.blobType {
+			t.Errorf("Invalid directory blob type, expected: %v, got: %v", data.blobType, blobType)
+		}
+	}
+}
+
+func TestDirEntryAttributes(t *testing.T) {
+
+	a := NewEntryAttributes(map[string]string{"owner": "root", "group": "wheel"})
+	if names := a.Names(); len(names) != 2 || names[0] != "group" || names[1] != "owner" {
+		t.Fatalf("Invalid attribute names: %v", names)
+	}
+	if v, ok := a.Get("owner"); !ok || v != "root" {
+		t.Fatalf("Invalid attribute value: %v", v)
+	}
+	if _, ok := a.Get("mode"); ok {
+		t.Fatal("Got value of missing attribute")
+	}
+	if NewEntryAttributes(nil) != nil || NewEntryAttributes(map[string]string{}) != nil {
+		t.Fatal("Empty attribute set must be nil")
+	}
+
+	// Entries stay comparable, attribute sets are compared by content in Equal
+	e1 := DirEntry{Name: "a", Bid: "bid", Key: "key", Attributes: a}
+	e2 := e1
+	e2.Attributes = NewEntryAttributes(map[string]string{"owner": "root", "group": "wheel"})
+	seen := map[DirEntry]bool{e1: true}
+	if !seen[e1] || !e1.Equal(&e2) {
+		t.Fatal("Entries with the same attributes must be equal")
+	}
+	e2.Attributes = NewEntryAttributes(map[string]string{"owner": "nobody", "group": "wheel"})
+	if e1.Equal(&e2) {
+		t.Fatal("Entries with different attributes must not be equal")
+	}
+	e2.Attributes = nil
+	if e1.Equal(&e2) || e2.Equal(&e1) {
+		t.Fatal("Entries with and without attributes must not be equal")
+	}
+}
@@ -6,7 +6,7 @@ package blobstore
 
 import (
 	"bytes"
-	"io"
+	"github.com/cinode/golib/cipherfactory"
 	"sort"
 )
 
@@ -31,14 +31,106 @@ type DirBlobWriter struct {
 	// Storage Object
 	Storage BlobStorage
 
+	// Cipher factory, default one is used if nil
+	CipherFactory cipherfactory.Factory
+
+	// Secret mixed into the key derivation, blobs are deduplicated only
+	// among writers using the same secret, no secret is used if empty
+	ConvergenceSecret []byte
+
 	// A list of currently handled entries
 	entries []*DirEntry
+
+	// Entries indexed by name, used to detect duplicates
+	names map[string]*DirEntry
 }
 
 // Adds a new entry to the directory
-// TODO: Don't allow adding duplicated entries 
 func (d *DirBlobWriter) AddEntry(entry DirEntry) error {
+	if d.names == nil {
+		d.names = make(map[string]*DirEntry)
+	}
+	if _, exists := d.names[entry.Name]; exists {
+		return ErrDuplicateDirEntry
+	}
 	d.entries = append(d.entries, &entry)
+	d.names[entry.Name] = &entry
+	return nil
+}
+
+// Load all entries of an existing directory blob into the writer,
+// entries already added to the writer are preserved
+func (d *DirBlobWriter) Load(bid, key string) error {
+
+	reader := NewDirBlobReaderWithFactory(d.Storage, d.CipherFactory)
+	if err := reader.Open(bid, key); err != nil {
+		return err
+	}
+
+	for reader.IsNextEntry() {
+		entry, err := reader.NextEntry()
+		if err != nil {
+			return err
+		}
+		if err = d.AddEntry(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get the entry with given name
+func (d *DirBlobWriter) GetEntry(name string) (entry DirEntry, ok bool) {
+	e, ok := d.names[name]
+	if !ok {
+		return DirEntry{}, false
+	}
+	return *e, true
+}
+
+// Remove the entry with given name from the directory
+func (d *DirBlobWriter) RemoveEntry(name string) error {
+	entry, ok := d.names[name]
+	if !ok {
+		return ErrDirEntryNotFound
+	}
+	for i, e := range d.entries {
+		if e == entry {
+			d.entries = append(d.entries[:i], d.entries[i+1:]...)
+			break
+		}
+	}
+	delete(d.names, name)
+	return nil
+}
+
+// Change the name of an existing entry, the new name must not be used
+// by any other entry
+func (d *DirBlobWriter) RenameEntry(oldName, newName string) error {
+	entry, ok := d.names[oldName]
+	if !ok {
+		return ErrDirEntryNotFound
+	}
+	if oldName == newName {
+		return nil
+	}
+	if _, exists := d.names[newName]; exists {
+		return ErrDuplicateDirEntry
+	}
+	entry.Name = newName
+	delete(d.names, oldName)
+	d.names[newName] = entry
+	return nil
+}
+
+// Replace the entry having the same name as the given one
+func (d *DirBlobWriter) ReplaceEntry(entry DirEntry) error {
+	existing, ok := d.names[entry.Name]
+	if !ok {
+		return ErrDirEntryNotFound
+	}
+	*existing = entry
 	return nil
 }
 
@@ -54,22 +146,42 @@ func (d *DirBlobWriter) finalizeSimple() (bid string, key string, err error) {
 	// Sort entries by name
 	sort.Sort(sortByName(d.entries))
 
+	// Use the versioned format only if it's really needed,
+	// this keeps legacy readers working for legacy entries
+	extended := false
+	for _, entry := range d.entries {
+		if entry.hasExtendedMetadata() {
+			extended = true
+			break
+		}
+	}
+
 	// Serialize the data
 	var buffer bytes.Buffer
-	buffer.WriteByte(blobTypeSimpleStaticDir)
+	if extended {
+		buffer.WriteByte(blobTypeSimpleStaticDirV2)
+	} else {
+		buffer.WriteByte(blobTypeSimpleStaticDir)
+	}
 
 	// Number of entries first
 	serializeInt(int64(len(d.entries)), &buffer)
 
 	// All entries right after
 	for _, entry := range d.entries {
-		entry.serialize(&buffer)
+		if extended {
+			entry.serializeV2(&buffer)
+		} else {
+			entry.serialize(&buffer)
+		}
 	}
 
 	// Create blob out of the data
-	return createHashValidatedBlobFromReaderGenerator(
-		func() io.Reader { return bytes.NewReader(buffer.Bytes()) },
-		d.Storage)
+	return createHashValidatedBlob(
+		bytes.NewReader(buffer.Bytes()),
+		d.Storage,
+		d.CipherFactory,
+		d.ConvergenceSecret)
 }
 
 func (d *DirBlobWriter) finalizeSplit() (bid string, key string, err error) {
@@ -151,3 +151,105 @@ func TestSimpleDirs(t *testing.T) {
 		}
 	}
 }
+
+func readDirEntries(t *testing.T, storage BlobStorage, bid, key string) map[string]DirEntry {
+	r := NewDirBlobReader(storage)
+	if err := r.Open(bid, key); err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]DirEntry)
+	for r.IsNextEntry() {
+		entry, err := r.NextEntry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[entry.Name] = entry
+	}
+	return entries
+}
+
+func TestDirDuplicatedEntries(t *testing.T) {
+
+	dw := DirBlobWriter{Storage: NewMemoryBlobStorage()}
+
+	if err := dw.AddEntry(DirEntry{Name: "a", Bid: "bid", Key: "key"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dw.AddEntry(DirEntry{Name: "b", Bid: "bid", Key: "key"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dw.AddEntry(DirEntry{Name: "a", Bid: "bid2", Key: "key2"}); err != ErrDuplicateDirEntry {
+		t.Fatalf("Invalid error for duplicated entry: %v", err)
+	}
+	if err := dw.RenameEntry("b", "a"); err != ErrDuplicateDirEntry {
+		t.Fatalf("Invalid error for rename to existing name: %v", err)
+	}
+}
+
+func TestDirEditing(t *testing.T) {
+
+	m := NewMemoryBlobStorage()
+	dw := DirBlobWriter{Storage: m}
+	dw.AddEntry(DirEntry{Name: "a", MimeType: "text/plain", Bid: "bida", Key: "keya"})
+	dw.AddEntry(DirEntry{Name: "b", MimeType: "text/plain", Bid: "bidb", Key: "keyb"})
+	dw.AddEntry(DirEntry{Name: "c", MimeType: "text/plain", Bid: "bidc", Key: "keyc"})
+	bid, key, err := dw.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Edit the directory
+	ew := DirBlobWriter{Storage: m}
+	if err = ew.Load(bid, key); err != nil {
+		t.Fatal(err)
+	}
+	if err = ew.RemoveEntry("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ew.RenameEntry("b", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ew.ReplaceEntry(DirEntry{Name: "c", MimeType: "text/html", Bid: "bidc2", Key: "keyc2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = ew.RemoveEntry("a"); err != ErrDirEntryNotFound {
+		t.Fatalf("Invalid error when removing missing entry: %v", err)
+	}
+	if err = ew.RenameEntry("b", "e"); err != ErrDirEntryNotFound {
+		t.Fatalf("Invalid error when renaming missing entry: %v", err)
+	}
+	if err = ew.ReplaceEntry(DirEntry{Name: "x"}); err != ErrDirEntryNotFound {
+		t.Fatalf("Invalid error when replacing missing entry: %v", err)
+	}
+	bid2, key2, err := ew.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bid2 == bid || key2 == key {
+		t.Fatal("Edited directory must produce a new blob")
+	}
+
+	// Check the result
+	entries := readDirEntries(t, m, bid2, key2)
+	expected := []DirEntry{
+		{Name: "c", MimeType: "text/html", Bid: "bidc2", Key: "keyc2"},
+		{Name: "d", MimeType: "text/plain", Bid: "bidb", Key: "keyb"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Invalid number of entries, expected: %v, got: %v", len(expected), len(entries))
+	}
+	for _, e := range expected {
+		got, ok := entries[e.Name]
+		if !ok {
+			t.Fatalf("Missing entry: %v", e.Name)
+		}
+		if !got.Equal(&e) {
+			t.Fatalf("Invalid entry: %v", e.Name)
+		}
+	}
+
+	// Original directory must stay untouched
+	if entries = readDirEntries(t, m, bid, key); len(entries) != 3 {
+		t.Fatalf("Original directory modified")
+	}
+}
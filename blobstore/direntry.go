@@ -3,11 +3,120 @@ package blobstore
 import (
 	"bytes"
 	"io"
+	"sort"
+	"time"
 )
 
-// Helper structure for holding one directory entry
+// Kind of the object a directory entry points to
+type EntryKind int64
+
+const (
+	EntryKindUnknown EntryKind = iota // Kind not known, always the case for legacy directory blobs
+	EntryKindFile                     // Static file blob
+	EntryKindDir                      // Static directory blob
+	EntryKindSymlink                  // Symbolic link, target path stored in the pointed file blob
+	EntryKindLink                     // Link to a sign-validated (mutable) blob
+)
+
+// Helper structure for holding one directory entry, it's comparable
+// with == but entries with attributes are equal only if they share the
+// same attribute set, use Equal to compare the content
 type DirEntry struct {
 	Name, MimeType, Bid, Key string
+
+	// Extended metadata, stored only in the versioned directory format
+
+	Kind       EntryKind        // Kind of the entry
+	Size       int64            // Size of the content in bytes
+	ModTime    time.Time        // Modification time, zero if unknown
+	Mode       uint32           // POSIX mode bits
+	Attributes *EntryAttributes // Additional named attributes, nil if none
+}
+
+// Named attributes of the directory entry. The set can not be modified
+// once created thus it can be shared between copies of the entry.
+type EntryAttributes struct {
+	names  []string // Sorted by name
+	values []string
+}
+
+// Create attribute set from given map, nil is returned for empty map
+func NewEntryAttributes(attributes map[string]string) *EntryAttributes {
+	if len(attributes) == 0 {
+		return nil
+	}
+	a := &EntryAttributes{names: make([]string, 0, len(attributes))}
+	for name := range attributes {
+		a.names = append(a.names, name)
+	}
+	sort.Strings(a.names)
+	a.values = make([]string, len(a.names))
+	for i, name := range a.names {
+		a.values[i] = attributes[name]
+	}
+	return a
+}
+
+// Get the number of attributes
+func (a *EntryAttributes) Len() int {
+	if a == nil {
+		return 0
+	}
+	return len(a.names)
+}
+
+// Get the value of named attribute
+func (a *EntryAttributes) Get(name string) (value string, ok bool) {
+	if a == nil {
+		return "", false
+	}
+	i := sort.SearchStrings(a.names, name)
+	if i == len(a.names) || a.names[i] != name {
+		return "", false
+	}
+	return a.values[i], true
+}
+
+// Get names of all attributes in sorted order
+func (a *EntryAttributes) Names() []string {
+	if a == nil {
+		return nil
+	}
+	return append([]string{}, a.names...)
+}
+
+// Equal checks whether two attribute sets hold the same attributes
+func (a *EntryAttributes) Equal(o *EntryAttributes) bool {
+	if a.Len() != o.Len() {
+		return false
+	}
+	for i := 0; i < a.Len(); i++ {
+		if a.names[i] != o.names[i] || a.values[i] != o.values[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Check whether the entry does carry any metadata that can not be
+// represented in the legacy directory blob format
+func (d *DirEntry) hasExtendedMetadata() bool {
+	return d.Kind != EntryKindUnknown ||
+		d.Size != 0 ||
+		!d.ModTime.IsZero() ||
+		d.Mode != 0 ||
+		d.Attributes.Len() > 0
+}
+
+// Equal checks whether two directory entries hold the same data
+func (d *DirEntry) Equal(o *DirEntry) bool {
+	if d.Name != o.Name || d.MimeType != o.MimeType ||
+		d.Bid != o.Bid || d.Key != o.Key ||
+		d.Kind != o.Kind || d.Size != o.Size ||
+		!d.ModTime.Equal(o.ModTime) || d.Mode != o.Mode {
+		return false
+	}
+	return d.Attributes.Equal(o.Attributes)
 }
 
 func (d *DirEntry) serialize(b *bytes.Buffer) {
@@ -32,3 +141,123 @@ func (d *DirEntry) deserialize(r io.Reader) (err error) {
 	}
 	return nil
 }
+
+func (d *DirEntry) serializeV2(b *bytes.Buffer) {
+
+	// Base fields first, same as in the legacy format
+	d.serialize(b)
+
+	serializeInt(int64(d.Kind), b)
+	serializeInt(d.Size, b)
+
+	// Zero modification time is stored as a flag only
+	if d.ModTime.IsZero() {
+		serializeInt(0, b)
+	} else {
+		serializeInt(1, b)
+		serializeSignedInt(d.ModTime.Unix(), b)
+		serializeInt(int64(d.ModTime.Nanosecond()), b)
+	}
+
+	serializeInt(int64(d.Mode), b)
+
+	// Attributes are sorted by name which keeps the blob deterministic
+	serializeInt(int64(d.Attributes.Len()), b)
+	for i := 0; i < d.Attributes.Len(); i++ {
+		serializeString(d.Attributes.names[i], b)
+		serializeString(d.Attributes.values[i], b)
+	}
+}
+
+func (d *DirEntry) deserializeV2(r io.Reader) (err error) {
+	if err = d.deserialize(r); err != nil {
+		return
+	}
+
+	kind, err := deserializeInt(r)
+	if err != nil {
+		return
+	}
+	if kind < int64(EntryKindUnknown) || kind > int64(EntryKindLink) {
+		return ErrMalformedDirInvalidEntryKind
+	}
+	d.Kind = EntryKind(kind)
+
+	if d.Size, err = deserializeInt(r); err != nil {
+		return
+	}
+	if d.Size < 0 {
+		return ErrMalformedDirInvalidEntrySize
+	}
+
+	hasModTime, err := deserializeInt(r)
+	if err != nil {
+		return
+	}
+	switch hasModTime {
+	case 0:
+		d.ModTime = time.Time{}
+	case 1:
+		sec, err := deserializeSignedInt(r)
+		if err != nil {
+			return err
+		}
+		nsec, err := deserializeInt(r)
+		if err != nil {
+			return err
+		}
+		if nsec < 0 || nsec >= int64(time.Second) {
+			return ErrMalformedDirInvalidModTime
+		}
+		d.ModTime = time.Unix(sec, nsec).UTC()
+	default:
+		return ErrMalformedDirInvalidModTime
+	}
+
+	mode, err := deserializeInt(r)
+	if err != nil {
+		return
+	}
+	if mode < 0 || mode > 0xFFFFFFFF {
+		return ErrMalformedDirInvalidMode
+	}
+	d.Mode = uint32(mode)
+
+	attrCount, err := deserializeInt(r)
+	if err != nil {
+		return
+	}
+	if attrCount < 0 || attrCount > maxSaneDirEntryAttributes {
+		return ErrMalformedDirInvalidAttributes
+	}
+	d.Attributes = nil
+	if attrCount == 0 {
+		return nil
+	}
+	attributes := &EntryAttributes{
+		names:  make([]string, 0, attrCount),
+		values: make([]string, 0, attrCount),
+	}
+	lastName := ""
+	for i := int64(0); i < attrCount; i++ {
+		name, err := deserializeString(r, maxSaneAttributeNameLength)
+		if err != nil {
+			return err
+		}
+		value, err := deserializeString(r, maxSaneAttributeValueLength)
+		if err != nil {
+			return err
+		}
+
+		// Names must be unique and sorted
+		if i > 0 && name <= lastName {
+			return ErrMalformedDirInvalidAttributes
+		}
+		lastName = name
+		attributes.names = append(attributes.names, name)
+		attributes.values = append(attributes.values, value)
+	}
+	d.Attributes = attributes
+
+	return nil
+}
@@ -1,6 +1,9 @@
 package blobstore
 
-import "errors"
+import (
+	"errors"
+	"github.com/cinode/golib/cipherfactory"
+)
 
 var (
 	ErrInvalidValidationMethod = errors.New("Invalid blob validation method")
@@ -15,7 +18,32 @@ var (
 	ErrMalformedDirInvalidEntriesCount = errors.New("Invalid directory blob - incorrect number of entries found")
 	ErrMalformedDirExtraData           = errors.New("Invalid directory blob - extra bytes found at the end")
 	ErrNoMoreDirEntries                = errors.New("No more directory entries found")
+	ErrMalformedDirInvalidEntryKind    = errors.New("Invalid directory blob - unknown entry kind")
+	ErrMalformedDirInvalidEntrySize    = errors.New("Invalid directory blob - incorrect entry size")
+	ErrMalformedDirInvalidModTime      = errors.New("Invalid directory blob - incorrect entry modification time")
+	ErrMalformedDirInvalidMode         = errors.New("Invalid directory blob - incorrect entry mode")
+	ErrMalformedDirInvalidAttributes   = errors.New("Invalid directory blob - incorrect entry attributes")
+	ErrDuplicateDirEntry               = errors.New("Directory entry with such name already exists")
+	ErrDirEntryNotFound                = errors.New("Directory entry with such name does not exist")
+
+	ErrInvalidTreeOp    = errors.New("Invalid tree operation")
+	ErrInvalidTreePath  = errors.New("Invalid path in the directory tree")
+	ErrTreePathNotFound = errors.New("Path not found in the directory tree")
+	ErrTreePathExists   = errors.New("Path already exists in the directory tree")
+	ErrNotADirectory    = errors.New("Entry is not a directory")
+
+	ErrNoMoreTreeChanges = errors.New("No more changes between directory trees found")
+	ErrMergeConflict     = errors.New("Conflicting changes found while merging directory trees")
+
+	ErrInvalidPublicKeyBid      = errors.New("Invalid public key - does not match blob id")
+	ErrUnknownPublicKeyType     = errors.New("Unknown public key type")
+	ErrInvalidSignature         = errors.New("Invalid blob signature")
+	ErrMalformedSignedBlobNonce = errors.New("Invalid signed blob - incorrect nonce")
+
+	ErrMalformedSignedBlobKeys = errors.New("Malformed signed blob key bundle")
 
-	ErrInvalidPublicKeyBid  = errors.New("Invalid public key - does not match blob id")
-	ErrUnknownPublicKeyType = errors.New("Unknown public key type")
+	// Errors of the cipher layer, kept for compatibility
+	ErrInsufficientKeySource = cipherfactory.ErrInsufficientKeySource
+	ErrInvalidKey            = cipherfactory.ErrInvalidKey
+	ErrUnknownKeyType        = cipherfactory.ErrUnknownKeyType
 )
@@ -1,6 +1,7 @@
 package blobstore
 
 import (
+	"github.com/cinode/golib/cipherfactory"
 	"io"
 )
 
@@ -23,9 +24,15 @@ type fileBlobReader struct {
 }
 
 func NewFileBlobReader(storage BlobStorage) FileBlobReader {
+	return NewFileBlobReaderWithFactory(storage, nil)
+}
+
+// Create file blob reader using given cipher factory
+func NewFileBlobReaderWithFactory(storage BlobStorage, cf cipherfactory.Factory) FileBlobReader {
 	return &fileBlobReader{
 		baseBlobReader: baseBlobReader{
-			storage: storage}}
+			storage: storage,
+			cf:      cf}}
 }
 
 // Open does open blob with given bid and key
@@ -7,8 +7,9 @@ package blobstore
 // TODO: Support for duplicates (let write the blob with same id as long as the content does match)
 
 import (
-	"os"
 	"io"
+	"io/ioutil"
+	"os"
 )
 
 func NewFileBlobStorage(path string) BlobStorage {
@@ -50,6 +51,37 @@ func (s *fileBlobStorage) NewBlobWriter(blobId string) (writer WriteFinalizeCanc
 	return &fileBlobWriter{fl}, nil
 }
 
+type fileDeferredBlobWriter struct {
+	storage *fileBlobStorage
+	fl      *os.File
+}
+
+func (f *fileDeferredBlobWriter) Write(p []byte) (n int, err error) {
+	return f.fl.Write(p)
+}
+
+func (f *fileDeferredBlobWriter) Finalize(blobId string) error {
+	if err := f.fl.Close(); err != nil {
+		os.Remove(f.fl.Name())
+		return err
+	}
+	return os.Rename(f.fl.Name(), f.storage.blobPath(blobId))
+}
+
+func (f *fileDeferredBlobWriter) Cancel() error {
+	f.fl.Close()
+	os.Remove(f.fl.Name())
+	return nil
+}
+
+func (s *fileBlobStorage) NewDeferredBlobWriter() (writer DeferredBlobWriter, err error) {
+	fl, err := ioutil.TempFile(s.path, ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	return &fileDeferredBlobWriter{storage: s, fl: fl}, nil
+}
+
 func (s *fileBlobStorage) NewBlobReader(blobId string) (reader io.Reader, err error) {
 	return os.OpenFile(s.blobPath(blobId), os.O_RDONLY, 0666)
 }
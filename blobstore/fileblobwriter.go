@@ -6,18 +6,29 @@ package blobstore
 
 import (
 	"bytes"
-	"io"
+	"github.com/cinode/golib/cipherfactory"
 )
 
 // Structure used to generate static file blobs
 type FileBlobWriter struct {
 
-	// Buffer for storing data before we can hash it
-	buffer bytes.Buffer
+	// Spool for storing data of the current part before we can hash it,
+	// it does contain the blob header followed by the data
+	buffer spool
+
+	// Number of data bytes in the current part
+	partBytes int
 
 	// Storage object
 	Storage BlobStorage
 
+	// Cipher factory, default one is used if nil
+	CipherFactory cipherfactory.Factory
+
+	// Secret mixed into the key derivation, blobs are deduplicated only
+	// among writers using the same secret, no secret is used if empty
+	ConvergenceSecret []byte
+
 	// List of partial file blobs
 	partialBids, partialKeys []string
 
@@ -28,7 +39,7 @@ type FileBlobWriter struct {
 // Performing a write operation on the file blob
 func (f *FileBlobWriter) Write(p []byte) (n int, err error) {
 
-	bufferSpaceLeft := maxSimpleFileDataSize - f.buffer.Len()
+	bufferSpaceLeft := maxSimpleFileDataSize - f.partBytes
 	written := 0
 	for len(p) > 0 {
 
@@ -39,7 +50,17 @@ func (f *FileBlobWriter) Write(p []byte) (n int, err error) {
 		}
 
 		// Chop off the next part
-		f.buffer.Write(p[:partialSize])
+		if f.partBytes == 0 {
+			if _, err := f.buffer.Write([]byte{blobTypeSimpleStaticFile}); err != nil {
+				f.Cancel()
+				return 0, err
+			}
+		}
+		if _, err := f.buffer.Write(p[:partialSize]); err != nil {
+			f.Cancel()
+			return 0, err
+		}
+		f.partBytes += partialSize
 		p = p[partialSize:]
 		bufferSpaceLeft -= partialSize
 		written += partialSize
@@ -60,17 +81,15 @@ func (f *FileBlobWriter) Write(p []byte) (n int, err error) {
 // save it's id and key in a list of partial blobs
 func (f *FileBlobWriter) finalizePartialBuffer() error {
 
-	// Create the header
-	var hdr bytes.Buffer
-	hdr.WriteByte(blobTypeSimpleStaticFile)
+	// Empty part does contain the header only
+	if f.partBytes == 0 {
+		if _, err := f.buffer.Write([]byte{blobTypeSimpleStaticFile}); err != nil {
+			return err
+		}
+	}
 
 	// Generate the blob
-	readerGen := func() io.Reader {
-		headerReader := bytes.NewReader(hdr.Bytes())
-		contentReader := bytes.NewReader(f.buffer.Bytes())
-		return io.MultiReader(headerReader, contentReader)
-	}
-	bid, key, err := createHashValidatedBlobFromReaderGenerator(readerGen, f.Storage)
+	bid, key, err := createHashValidatedBlob(f.buffer.Reader(), f.Storage, f.CipherFactory, f.ConvergenceSecret)
 	if err != nil {
 		return err
 	}
@@ -79,12 +98,11 @@ func (f *FileBlobWriter) finalizePartialBuffer() error {
 	f.addPartialBlob(bid, key)
 
 	// Increase the counter of bytes thrown out so far
-	f.totalBytes += int64(f.buffer.Len())
+	f.totalBytes += int64(f.partBytes)
 
 	// Cleanup
-	f.buffer.Reset()
-
-	return nil
+	f.partBytes = 0
+	return f.buffer.Reset()
 }
 
 // Save bid and key into a list of partial blobs
@@ -97,12 +115,13 @@ func (f *FileBlobWriter) addPartialBlob(bid, key string) {
 func (f *FileBlobWriter) Finalize() (bid string, key string, err error) {
 
 	// Throw out the last partial if needed
-	if f.buffer.Len() > 0 || len(f.partialBids) == 0 {
+	if f.partBytes > 0 || len(f.partialBids) == 0 {
 		if err := f.finalizePartialBuffer(); err != nil {
 			f.Cancel()
 			return "", "", err
 		}
 	}
+	f.buffer.Close()
 
 	// If there's only one partial in the list, we don't have to create
 	// any split file blobs
@@ -134,9 +153,11 @@ func (f *FileBlobWriter) finalizeSplitFile() (bid string, key string, err error)
 	}
 
 	// Write it all to the storage
-	return createHashValidatedBlobFromReaderGenerator(
-		func() io.Reader { return bytes.NewReader(b.Bytes()) },
-		f.Storage)
+	return createHashValidatedBlob(
+		bytes.NewReader(b.Bytes()),
+		f.Storage,
+		f.CipherFactory,
+		f.ConvergenceSecret)
 }
 
 // Cancel the generation of file blob.
@@ -148,6 +169,7 @@ func (f *FileBlobWriter) Cancel() {
 
 	f.partialBids = nil
 	f.partialKeys = nil
-	f.buffer.Reset()
+	f.buffer.Close()
+	f.partBytes = 0
 	f.totalBytes = 0
 }
@@ -7,7 +7,9 @@ package blobstore
 import (
 	"bytes"
 	"encoding/hex"
+	"io"
 	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 )
@@ -195,3 +197,123 @@ func TestSplitFiles1(t *testing.T) {
 		m,
 	)
 }
+
+// Storage hiding the support for deferred blob ids
+type nonDeferredBlobStorage struct {
+	BlobStorage
+}
+
+// Reader that can not be rewound
+type oneShotReader struct {
+	data []byte
+}
+
+func (r *oneShotReader) Read(p []byte) (n int, err error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n = copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestFileBlobStreaming(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "cinode-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, maxSpoolMemorySize*3+17)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	storages := []BlobStorage{
+		NewMemoryBlobStorage(),
+		nonDeferredBlobStorage{NewMemoryBlobStorage()},
+		NewFileBlobStorage(dir),
+	}
+
+	var firstBid, firstKey string
+	for i, storage := range storages {
+
+		fw := FileBlobWriter{Storage: storage}
+		if _, err := io.Copy(&fw, &oneShotReader{data: data}); err != nil {
+			t.Fatal(err)
+		}
+		bid, key, err := fw.Finalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 0 {
+			firstBid, firstKey = bid, key
+		} else if bid != firstBid || key != firstKey {
+			t.Fatalf("Storage %v generated different blob", i)
+		}
+
+		fr := NewFileBlobReader(storage)
+		if err = fr.Open(bid, key); err != nil {
+			t.Fatal(err)
+		}
+		read, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(read, data) {
+			t.Fatalf("Storage %v: invalid data read", i)
+		}
+	}
+}
+
+func TestHashValidatedBlobFromReader(t *testing.T) {
+
+	data := make([]byte, maxSpoolMemorySize+17)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	storage := NewMemoryBlobStorage()
+	bid, key, err := createHashValidatedBlob(bytes.NewReader(data), storage, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Source that can't seek must give the same blob
+	for _, storage := range []BlobStorage{storage, nonDeferredBlobStorage{NewMemoryBlobStorage()}} {
+		bid2, key2, err := createHashValidatedBlob(&oneShotReader{data: data}, storage, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bid2 != bid || key2 != key {
+			t.Fatal("Different blob generated from non-seekable source")
+		}
+
+		reader, err := createReaderForHashBlob(bid, key, storage, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(read, data) {
+			t.Fatal("Invalid data read")
+		}
+	}
+
+	// Only the remaining part of partially read source is stored
+	source := bytes.NewReader(append([]byte("prefix"), data...))
+	if _, err = io.ReadFull(source, make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+	bid2, key2, err := createHashValidatedBlob(source, storage, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bid2 != bid || key2 != key {
+		t.Fatal("Different blob generated from partially read source")
+	}
+}
@@ -55,6 +55,21 @@ func (s *memoryBlobStorage) NewBlobWriter(blobId string) (writer WriteFinalizeCa
 		nil
 }
 
+type memoryDeferredBlobWriter struct {
+	memoryBlobWriter
+}
+
+func (f *memoryDeferredBlobWriter) Finalize(blobId string) error {
+	f.bid = blobId
+	return f.memoryBlobWriter.Finalize()
+}
+
+func (s *memoryBlobStorage) NewDeferredBlobWriter() (writer DeferredBlobWriter, err error) {
+	return &memoryDeferredBlobWriter{
+			memoryBlobWriter{storage: s}},
+		nil
+}
+
 func (s *memoryBlobStorage) NewBlobReader(blobId string) (reader io.Reader, err error) {
 	blob, ok := s.blobs[blobId]
 	if !ok {
@@ -14,6 +14,7 @@ import (
 var (
 	ErrDeserializeStringToLarge = errors.New("Could not deserialize string value due to invalid length")
 	ErrDeserializeStringNotUTF8 = errors.New("Could not deserialize string value - not a UTF-8 sequence")
+	ErrDeserializeIntOverflow   = errors.New("Could not deserialize integer value - overflow")
 )
 
 func serializeInt(v int64, buff *bytes.Buffer) {
@@ -32,6 +33,28 @@ func serializeInt(v int64, buff *bytes.Buffer) {
 	}
 }
 
+// Serialize signed integer using the zig-zag encoding so that
+// small negative numbers are also stored in few bytes
+func serializeSignedInt(v int64, buff *bytes.Buffer) {
+	serializeUnsignedInt(uint64(v<<1)^uint64(v>>63), buff)
+}
+
+func serializeUnsignedInt(v uint64, buff *bytes.Buffer) {
+	for {
+		b := byte(v & 0x7F)
+		v = v >> 7
+		if v != 0 {
+			b |= 0x80
+		}
+
+		buff.WriteByte(b)
+
+		if v == 0 {
+			break
+		}
+	}
+}
+
 func serializeBuffer(data []byte, buff *bytes.Buffer) {
 	serializeInt(int64(len(data)), buff)
 	buff.Write(data)
@@ -62,6 +85,29 @@ func deserializeInt(r io.Reader) (v int64, err error) {
 	return
 }
 
+func deserializeSignedInt(r io.Reader) (v int64, err error) {
+	u, s := uint64(0), uint(0)
+	buff := []byte{0}
+	for ; ; s += 7 {
+		if s >= 64 {
+			return 0, ErrDeserializeIntOverflow
+		}
+
+		// Get next byte
+		if _, err = r.Read(buff); err != nil {
+			return
+		}
+
+		// Fill in the data in returned value
+		u |= uint64(buff[0]&0x7F) << s
+
+		if (buff[0] & 0x80) == 0 {
+			break
+		}
+	}
+	return int64(u>>1) ^ -int64(u&1), nil
+}
+
 func deserializeBuffer(r io.Reader, maxLength int64) (data []byte, err error) {
 	length, err := deserializeInt(r)
 	if err != nil {
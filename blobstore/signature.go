@@ -0,0 +1,90 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blobstore
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"hash"
+	"io"
+)
+
+// Signature scheme used for signed blobs, selected by the type of the key.
+// The signature is always calculated over a digest of the signed data so
+// that it can be verified while the data is streamed.
+type signatureScheme struct {
+	hash       crypto.Hash
+	signerOpts crypto.SignerOpts
+	verify     func(pubKey crypto.PublicKey, digest, signature []byte) bool
+}
+
+var (
+	// RSA PKCS#1 v1.5 signature of the SHA-512 digest
+	signatureSchemeRSA = &signatureScheme{
+		hash:       crypto.SHA512,
+		signerOpts: crypto.SHA512,
+		verify: func(pubKey crypto.PublicKey, digest, signature []byte) bool {
+			return rsa.VerifyPKCS1v15(pubKey.(*rsa.PublicKey), crypto.SHA512, digest, signature) == nil
+		},
+	}
+
+	// Ed25519ph signature of the SHA-512 digest
+	signatureSchemeEd25519 = &signatureScheme{
+		hash:       crypto.SHA512,
+		signerOpts: &ed25519.Options{Hash: crypto.SHA512},
+		verify: func(pubKey crypto.PublicKey, digest, signature []byte) bool {
+			return ed25519.VerifyWithOptions(pubKey.(ed25519.PublicKey), digest, signature,
+				&ed25519.Options{Hash: crypto.SHA512}) == nil
+		},
+	}
+
+	// ECDSA P-256 ASN.1 signature of the SHA-256 digest
+	signatureSchemeECDSAP256 = &signatureScheme{
+		hash:       crypto.SHA256,
+		signerOpts: crypto.SHA256,
+		verify: func(pubKey crypto.PublicKey, digest, signature []byte) bool {
+			return ecdsa.VerifyASN1(pubKey.(*ecdsa.PublicKey), digest, signature)
+		},
+	}
+)
+
+// Find the signature scheme for given public key
+func getSignatureScheme(pubKey crypto.PublicKey) (*signatureScheme, error) {
+	switch k := pubKey.(type) {
+	case *rsa.PublicKey:
+		return signatureSchemeRSA, nil
+	case ed25519.PublicKey:
+		return signatureSchemeEd25519, nil
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return signatureSchemeECDSAP256, nil
+		}
+	}
+	return nil, ErrUnknownPublicKeyType
+}
+
+// Reader passing the signed data through while calculating its digest,
+// the signature is verified once the end of data is reached
+type signatureVerifyingReader struct {
+	reader    io.Reader
+	hasher    hash.Hash
+	scheme    *signatureScheme
+	pubKey    crypto.PublicKey
+	signature []byte
+}
+
+func (r *signatureVerifyingReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.hasher.Write(p[:n])
+	if err == io.EOF && !r.scheme.verify(r.pubKey, r.hasher.Sum(nil), r.signature) {
+		err = ErrInvalidSignature
+	}
+	return
+}
@@ -0,0 +1,100 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blobstore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"github.com/cinode/golib/cipherfactory"
+	"io"
+)
+
+// Keys used to write signed blobs.
+//
+// The read key is generated independently of the signing key, it's used as
+// the source of the data encryption key. Read access can be shared without
+// revealing anything about the signing key and leaking the signing key
+// does not give access to the content.
+type SignedBlobKeys struct {
+	signingKey crypto.Signer
+	readKey    []byte
+}
+
+// Create new key bundle for given signing key with random read key
+func NewSignedBlobKeys(signingKey crypto.Signer, cf cipherfactory.Factory) (*SignedBlobKeys, error) {
+
+	if _, err := getSignatureScheme(signingKey.Public()); err != nil {
+		return nil, err
+	}
+
+	// Factory not requiring any key source would give empty read key
+	keyLength := getCipherFactory(cf).GetMinKeySourceBytes()
+	if keyLength <= 0 {
+		return nil, ErrInsufficientKeySource
+	}
+	readKey := make([]byte, keyLength)
+	if _, err := io.ReadFull(rand.Reader, readKey); err != nil {
+		return nil, err
+	}
+
+	return &SignedBlobKeys{signingKey: signingKey, readKey: readKey}, nil
+}
+
+// Serialize the key bundle
+func (k *SignedBlobKeys) Marshal() ([]byte, error) {
+
+	privKey, err := x509.MarshalPKCS8PrivateKey(k.signingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.WriteByte(signedBlobKeysVersion)
+	serializeBuffer(privKey, &b)
+	serializeBuffer(k.readKey, &b)
+	return b.Bytes(), nil
+}
+
+// Deserialize the key bundle
+func UnmarshalSignedBlobKeys(data []byte) (*SignedBlobKeys, error) {
+
+	r := bytes.NewReader(data)
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != signedBlobKeysVersion {
+		return nil, ErrMalformedSignedBlobKeys
+	}
+
+	privKeyBytes, err := deserializeBuffer(r, maxSanePrivKeyLength)
+	if err != nil {
+		return nil, err
+	}
+	readKey, err := deserializeBuffer(r, maxSaneKeyLength)
+	if err != nil {
+		return nil, err
+	}
+	if len(readKey) == 0 || r.Len() != 0 {
+		return nil, ErrMalformedSignedBlobKeys
+	}
+
+	privKey, err := x509.ParsePKCS8PrivateKey(privKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	signingKey, ok := privKey.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnknownPublicKeyType
+	}
+	if _, err = getSignatureScheme(signingKey.Public()); err != nil {
+		return nil, err
+	}
+
+	return &SignedBlobKeys{signingKey: signingKey, readKey: readKey}, nil
+}
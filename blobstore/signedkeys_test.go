@@ -0,0 +1,164 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blobstore
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/cinode/golib/cipherfactory"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSignedBlobKeysMarshal(t *testing.T) {
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewSignedBlobKeys(privKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := keys.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys2, err := UnmarshalSignedBlobKeys(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keys.readKey, keys2.readKey) {
+		t.Fatal("Read key not restored")
+	}
+	if !privKey.Equal(keys2.signingKey) {
+		t.Fatal("Signing key not restored")
+	}
+
+	for _, invalid := range [][]byte{
+		nil,
+		{0x7F},
+		data[:len(data)-1],
+		append(append([]byte{}, data...), 0x00),
+	} {
+		if _, err = UnmarshalSignedBlobKeys(invalid); err == nil {
+			t.Fatalf("Malformed key bundle not detected: %x", invalid)
+		}
+	}
+}
+
+// Factory that does not require any key source
+type noKeySourceFactory struct {
+	cipherfactory.Factory
+}
+
+func (noKeySourceFactory) GetMinKeySourceBytes() int {
+	return 0
+}
+
+func TestSignedBlobKeysEmptyReadKey(t *testing.T) {
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewSignedBlobKeys(privKey, noKeySourceFactory{cipherfactory.Create()}); err != ErrInsufficientKeySource {
+		t.Fatalf("Empty read key generated: %v", err)
+	}
+
+	keys := &SignedBlobKeys{signingKey: privKey}
+	data, err := keys.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = UnmarshalSignedBlobKeys(data); err != ErrMalformedSignedBlobKeys {
+		t.Fatalf("Empty read key not detected: %v", err)
+	}
+
+	_, _, err = createSignValidatedBlobFromReaderGenerator(func() io.Reader {
+		return bytes.NewReader([]byte("Hello world!"))
+	}, keys, 1, NewMemoryBlobStorage(), nil)
+	if err != ErrInsufficientKeySource {
+		t.Fatalf("Empty read key used: %v", err)
+	}
+}
+
+func TestSignedBlobReadKeyIndependence(t *testing.T) {
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := NewMemoryBlobStorage()
+	testData := []byte("Hello world!")
+
+	// Two bundles sharing the signing key must use different read keys
+	var bids, keys []string
+	for i := 0; i < 2; i++ {
+		bundle, err := NewSignedBlobKeys(privKey, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bid, key, err := createSignValidatedBlobFromReaderGenerator(func() io.Reader {
+			return bytes.NewReader(testData)
+		}, bundle, int64(i), NewMemoryBlobStorage(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bids, keys = append(bids, bid), append(keys, key)
+	}
+	if bids[0] != bids[1] {
+		t.Fatal("Blob id must depend on the signing key only")
+	}
+	if keys[0] == keys[1] {
+		t.Fatal("Read key must not depend on the signing key")
+	}
+
+	// Bundle restored from the serialized form gives the same read key
+	bundle, err := NewSignedBlobKeys(privKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := bundle.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := UnmarshalSignedBlobKeys(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key1, err := createSignValidatedBlobFromReaderGenerator(func() io.Reader {
+		return bytes.NewReader(testData)
+	}, bundle, 1, storage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bid, key2, err := createSignValidatedBlobFromReaderGenerator(func() io.Reader {
+		return bytes.NewReader(testData)
+	}, restored, 2, NewMemoryBlobStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key1 != key2 {
+		t.Fatal("Restored bundle gives different read key")
+	}
+
+	reader, err := createReaderForSignedBlob(bid, key1, storage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, testData) {
+		t.Fatal("Invalid data read")
+	}
+}
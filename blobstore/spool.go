@@ -0,0 +1,93 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blobstore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Temporary storage for blob data. Small amount of data is kept in memory,
+// once it grows above the limit it's moved to a temporary file.
+type spool struct {
+	buffer bytes.Buffer
+	file   *os.File
+	size   int64
+
+	// Maximum number of bytes kept in memory, maxSpoolMemorySize if zero
+	memoryLimit int
+}
+
+func (s *spool) Write(p []byte) (n int, err error) {
+
+	if s.file == nil {
+		limit := s.memoryLimit
+		if limit == 0 {
+			limit = maxSpoolMemorySize
+		}
+		if s.buffer.Len()+len(p) <= limit {
+			n, err = s.buffer.Write(p)
+			s.size += int64(n)
+			return
+		}
+
+		// Too much data to keep in memory, move it to a file
+		if s.file, err = ioutil.TempFile("", "cinode-spool-"); err != nil {
+			return 0, err
+		}
+		if _, err = s.file.Write(s.buffer.Bytes()); err != nil {
+			return 0, err
+		}
+		s.buffer.Reset()
+	}
+
+	n, err = s.file.Write(p)
+	s.size += int64(n)
+	return
+}
+
+// Get the number of bytes in the spool
+func (s *spool) Len() int64 {
+	return s.size
+}
+
+// Get the reader for the whole content of the spool, the reader
+// is valid until the next modification of the spool
+func (s *spool) Reader() io.ReadSeeker {
+	if s.file == nil {
+		return bytes.NewReader(s.buffer.Bytes())
+	}
+	return io.NewSectionReader(s.file, 0, s.size)
+}
+
+// Remove all data from the spool, the spool can be used again
+func (s *spool) Reset() error {
+	s.buffer.Reset()
+	s.size = 0
+	if s.file == nil {
+		return nil
+	}
+	if err := s.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := s.file.Seek(0, io.SeekStart)
+	return err
+}
+
+// Release all resources held by the spool, the spool can be used again
+func (s *spool) Close() error {
+	s.buffer.Reset()
+	s.size = 0
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	err := s.file.Close()
+	os.Remove(name)
+	s.file = nil
+	return err
+}
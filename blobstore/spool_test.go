@@ -0,0 +1,55 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blobstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+
+	s := spool{memoryLimit: 16}
+	defer s.Close()
+
+	check := func(expected []byte) {
+		if s.Len() != int64(len(expected)) {
+			t.Fatalf("Invalid spool length: %v, expected %v", s.Len(), len(expected))
+		}
+		data, err := ioutil.ReadAll(s.Reader())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("Invalid spool content: %q, expected %q", data, expected)
+		}
+	}
+
+	s.Write([]byte("0123456789"))
+	check([]byte("0123456789"))
+	if s.file != nil {
+		t.Fatal("Small amount of data should be kept in memory")
+	}
+
+	s.Write([]byte("abcdefghij"))
+	check([]byte("0123456789abcdefghij"))
+	if s.file == nil {
+		t.Fatal("Large amount of data should be moved to a file")
+	}
+
+	if err := s.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	check(nil)
+
+	s.Write([]byte("Hello World!"))
+	check([]byte("Hello World!"))
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(nil)
+}
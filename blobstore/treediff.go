@@ -0,0 +1,244 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blobstore
+
+import (
+	"fmt"
+	"github.com/cinode/golib/cipherfactory"
+	"io"
+)
+
+// Type of a change found between two directory trees
+type TreeChangeType int
+
+const (
+	TreeChangeAdded       TreeChangeType = iota // Entry exists in the new tree only
+	TreeChangeRemoved                           // Entry exists in the old tree only
+	TreeChangeModified                          // Entry exists in both trees but differs
+	TreeChangeTypeChanged                       // Entry exists in both trees but is of different kind
+)
+
+// Single letter symbols of change types used in the text format
+var treeChangeSymbols = map[TreeChangeType]string{
+	TreeChangeAdded:       "A",
+	TreeChangeRemoved:     "D",
+	TreeChangeModified:    "M",
+	TreeChangeTypeChanged: "T",
+}
+
+func (t TreeChangeType) String() string {
+	if s, ok := treeChangeSymbols[t]; ok {
+		return s
+	}
+	return "?"
+}
+
+// Single change between two directory trees
+type TreeChange struct {
+	Type     TreeChangeType
+	Path     string   // Path of the entry relative to the root
+	IsDir    bool     // Flag indicating whether the changed entry is a directory (in the new tree if it exists there)
+	Old, New DirEntry // Entries in the old and new tree, zero value if the entry does not exist in given tree
+}
+
+// Streaming iterator over changes between two directory trees
+type TreeDiff interface {
+
+	// Test whether there's any more change left
+	IsNextChange() bool
+
+	// Get the next change, changes are reported in the order of paths,
+	// a directory is always reported before its content
+	NextChange() (TreeChange, error)
+}
+
+// One pair of directories being compared
+type treeDiffFrame struct {
+	prefix   string
+	old, new []DirEntry
+}
+
+type treeDiff struct {
+	storage BlobStorage
+	cf      cipherfactory.Factory
+	stack   []*treeDiffFrame
+	next    *TreeChange // Change found in advance, nil if not searched yet
+	err     error       // Error found while searching for the next change
+}
+
+// Create a diff between two trees identified by bids and keys of root
+// directories. Subtrees with equal bids are skipped without reading them.
+// Options can be nil.
+func NewTreeDiff(storage BlobStorage, oldBid, oldKey, newBid, newKey string, opts *TreeOptions) TreeDiff {
+
+	d := &treeDiff{storage: storage, cf: opts.cipherFactory()}
+	if oldBid == newBid {
+		return d
+	}
+
+	oldRoot := DirEntry{Bid: oldBid, Key: oldKey, Kind: EntryKindDir}
+	newRoot := DirEntry{Bid: newBid, Key: newKey, Kind: EntryKindDir}
+
+	frame := &treeDiffFrame{}
+	if frame.old, d.err = loadDirEntries(storage, d.cf, &oldRoot); d.err != nil {
+		return d
+	}
+	if frame.new, d.err = loadDirEntries(storage, d.cf, &newRoot); d.err != nil {
+		return d
+	}
+	d.stack = append(d.stack, frame)
+
+	return d
+}
+
+func (d *treeDiff) IsNextChange() bool {
+	if d.next == nil && d.err == nil {
+		d.next, d.err = d.findNext()
+	}
+	return d.next != nil || d.err != nil
+}
+
+func (d *treeDiff) NextChange() (change TreeChange, err error) {
+	if !d.IsNextChange() {
+		return TreeChange{}, ErrNoMoreTreeChanges
+	}
+	if d.err != nil {
+		return TreeChange{}, d.err
+	}
+	change, d.next = *d.next, nil
+	return change, nil
+}
+
+// Check whether two entries of the same kind carry different metadata,
+// content of the entry is not compared
+func metadataDiffers(a, b *DirEntry) bool {
+	ac, bc := *a, *b
+	ac.Bid, ac.Key, ac.Size = "", "", 0
+	bc.Bid, bc.Key, bc.Size = "", "", 0
+	return !ac.Equal(&bc)
+}
+
+func (d *treeDiff) findNext() (*TreeChange, error) {
+
+	for len(d.stack) > 0 {
+
+		frame := d.stack[len(d.stack)-1]
+
+		// Pick the entry with the lowest name from either side
+		var oldEntry, newEntry *DirEntry
+		switch {
+		case len(frame.old) == 0 && len(frame.new) == 0:
+			d.stack = d.stack[:len(d.stack)-1]
+			continue
+		case len(frame.new) == 0 || (len(frame.old) > 0 && frame.old[0].Name < frame.new[0].Name):
+			oldEntry, frame.old = &frame.old[0], frame.old[1:]
+		case len(frame.old) == 0 || frame.new[0].Name < frame.old[0].Name:
+			newEntry, frame.new = &frame.new[0], frame.new[1:]
+		default:
+			oldEntry, frame.old = &frame.old[0], frame.old[1:]
+			newEntry, frame.new = &frame.new[0], frame.new[1:]
+		}
+
+		// Identical entries, nothing to check deeper
+		if oldEntry != nil && newEntry != nil && oldEntry.Equal(newEntry) {
+			continue
+		}
+
+		change := &TreeChange{}
+		var oldChildren, newChildren []DirEntry
+		var oldIsDir, newIsDir bool
+		var err error
+
+		if oldEntry != nil {
+			change.Path = frame.prefix + oldEntry.Name
+			change.Old = *oldEntry
+
+			// Same bid in both trees means the same content
+			// thus there's no need to load the old directory
+			if newEntry == nil || newEntry.Bid != oldEntry.Bid {
+				if oldChildren, oldIsDir, err = probeDirEntries(d.storage, d.cf, oldEntry); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if newEntry != nil {
+			change.Path = frame.prefix + newEntry.Name
+			change.New = *newEntry
+			if oldEntry == nil || newEntry.Bid != oldEntry.Bid {
+				if newChildren, newIsDir, err = probeDirEntries(d.storage, d.cf, newEntry); err != nil {
+					return nil, err
+				}
+			} else {
+				newIsDir = newEntry.Kind == EntryKindDir
+			}
+		}
+
+		switch {
+		case newEntry == nil:
+			change.Type = TreeChangeRemoved
+			change.IsDir = oldIsDir
+		case oldEntry == nil:
+			change.Type = TreeChangeAdded
+			change.IsDir = newIsDir
+		case oldEntry.Bid == newEntry.Bid:
+			// Only metadata could have changed here
+			change.IsDir = newIsDir || oldEntry.Kind == EntryKindDir
+			if oldEntry.Kind != newEntry.Kind &&
+				oldEntry.Kind != EntryKindUnknown && newEntry.Kind != EntryKindUnknown {
+				change.Type = TreeChangeTypeChanged
+			} else {
+				change.Type = TreeChangeModified
+			}
+		case oldIsDir != newIsDir ||
+			(oldEntry.Kind != newEntry.Kind &&
+				oldEntry.Kind != EntryKindUnknown && newEntry.Kind != EntryKindUnknown):
+			change.Type = TreeChangeTypeChanged
+			change.IsDir = newIsDir
+		default:
+			change.Type = TreeChangeModified
+			change.IsDir = newIsDir
+		}
+
+		// Descend into directories unless the type has changed
+		if change.Type != TreeChangeTypeChanged && (oldChildren != nil || newChildren != nil) {
+			d.stack = append(d.stack, &treeDiffFrame{
+				prefix: change.Path + "/",
+				old:    oldChildren,
+				new:    newChildren,
+			})
+		}
+
+		// Modified directories are reported only if their own metadata
+		// has changed, changes to the content are reported separately
+		if change.Type == TreeChangeModified && change.IsDir &&
+			oldEntry.Bid != newEntry.Bid && !metadataDiffers(oldEntry, newEntry) {
+			continue
+		}
+
+		return change, nil
+	}
+
+	return nil, nil
+}
+
+// Write all changes from the diff in a text form, one change per line:
+// a single letter change type (A, D, M or T), a tab and the path,
+// directory paths end with a slash
+func WriteTreeDiff(w io.Writer, diff TreeDiff) error {
+	for diff.IsNextChange() {
+		change, err := diff.NextChange()
+		if err != nil {
+			return err
+		}
+		path := change.Path
+		if change.IsDir {
+			path += "/"
+		}
+		if _, err = fmt.Fprintf(w, "%v\t%v\n", change.Type, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
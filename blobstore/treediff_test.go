@@ -0,0 +1,101 @@
+package blobstore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTreeDiff(t *testing.T) {
+
+	storage, bid, key := genTestTree(t)
+
+	symlink := fileEntry("f2")
+	symlink.Kind = EntryKindSymlink
+
+	chmod := fileEntry("f3")
+	chmod.Mode = 0600
+
+	newBid, newKey, err := UpdateTree(storage, bid, key, []TreeOp{
+		{Type: TreeOpPut, Path: "a/b/f1", Entry: fileEntry("f1new")},
+		{Type: TreeOpPut, Path: "a/f2", Entry: symlink},
+		{Type: TreeOpPut, Path: "x/f3", Entry: chmod},
+		{Type: TreeOpPut, Path: "n/f4", Entry: fileEntry("f4")},
+		{Type: TreeOpDelete, Path: "empty"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err = WriteTreeDiff(&b, NewTreeDiff(storage, bid, key, newBid, newKey, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "" +
+		"M\ta/b/f1\n" +
+		"T\ta/f2\n" +
+		"D\tempty/\n" +
+		"A\tn/\n" +
+		"A\tn/f4\n" +
+		"M\tx/f3\n"
+	if b.String() != expected {
+		t.Fatalf("Invalid diff, expected:\n%v\ngot:\n%v", expected, b.String())
+	}
+
+	// Reversed diff
+	b.Reset()
+	if err = WriteTreeDiff(&b, NewTreeDiff(storage, newBid, newKey, bid, key, nil)); err != nil {
+		t.Fatal(err)
+	}
+	expected = "" +
+		"M\ta/b/f1\n" +
+		"T\ta/f2\n" +
+		"A\tempty/\n" +
+		"D\tn/\n" +
+		"D\tn/f4\n" +
+		"M\tx/f3\n"
+	if b.String() != expected {
+		t.Fatalf("Invalid diff, expected:\n%v\ngot:\n%v", expected, b.String())
+	}
+}
+
+func TestTreeDiffIdentical(t *testing.T) {
+
+	storage, bid, key := genTestTree(t)
+
+	d := NewTreeDiff(storage, bid, key, bid, key, nil)
+	if d.IsNextChange() {
+		t.Fatal("Found changes between identical trees")
+	}
+	if _, err := d.NextChange(); err != ErrNoMoreTreeChanges {
+		t.Fatalf("Invalid error when reading past the last change: %v", err)
+	}
+}
+
+func TestTreeDiffSkipsSharedSubtrees(t *testing.T) {
+
+	storage, bid, key := genTestTree(t)
+
+	newBid, newKey, err := UpdateTree(storage, bid, key, []TreeOp{
+		{Type: TreeOpPut, Path: "x/f5", Entry: fileEntry("f5")},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove the shared subtree from the storage, the diff must not need it
+	tree := readTree(t, storage, bid, key, "", nil)
+	delete(storage.(*memoryBlobStorage).blobs, tree["a"].Bid)
+
+	d := NewTreeDiff(storage, bid, key, newBid, newKey, nil)
+	change, err := d.NextChange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Type != TreeChangeAdded || change.Path != "x/f5" || change.New.Bid != "f5" {
+		t.Fatalf("Invalid change: %v %v", change.Type, change.Path)
+	}
+	if d.IsNextChange() {
+		t.Fatal("Extra changes found")
+	}
+}
@@ -0,0 +1,369 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blobstore
+
+import (
+	"github.com/cinode/golib/cipherfactory"
+	"strings"
+)
+
+// Type of a single tree update operation
+type TreeOpType int
+
+const (
+	TreeOpPut    TreeOpType = iota // Put Entry at Path replacing any existing entry
+	TreeOpDelete                   // Delete the entry at Path
+	TreeOpMkdir                    // Create directory at Path
+	TreeOpMove                     // Move the entry from Path to NewPath
+)
+
+// Single operation applied to a directory tree
+type TreeOp struct {
+	Type    TreeOpType
+	Path    string
+	NewPath string   // Destination, used by TreeOpMove only
+	Entry   DirEntry // New entry, used by TreeOpPut only, the name is taken from the Path
+}
+
+// Options used when reading and writing directory trees
+type TreeOptions struct {
+
+	// Cipher factory, default one is used if nil
+	CipherFactory cipherfactory.Factory
+
+	// Convergence secret used when writing directory blobs
+	ConvergenceSecret []byte
+}
+
+// Get the cipher factory, nil options give the default one
+func (o *TreeOptions) cipherFactory() cipherfactory.Factory {
+	if o == nil {
+		return nil
+	}
+	return o.CipherFactory
+}
+
+// Get the convergence secret, nil options give no secret
+func (o *TreeOptions) convergenceSecret() []byte {
+	if o == nil {
+		return nil
+	}
+	return o.ConvergenceSecret
+}
+
+// Apply a batch of operations to the directory tree identified by given
+// root bid and key, returns bid and key of the new root. Options can be nil.
+func UpdateTree(storage BlobStorage, bid, key string, ops []TreeOp, opts *TreeOptions) (newBid, newKey string, err error) {
+
+	editor := NewTreeEditor(storage, bid, key)
+	editor.CipherFactory = opts.cipherFactory()
+	editor.ConvergenceSecret = opts.convergenceSecret()
+	for _, op := range ops {
+		switch op.Type {
+		case TreeOpPut:
+			err = editor.Put(op.Path, op.Entry)
+		case TreeOpDelete:
+			err = editor.Delete(op.Path)
+		case TreeOpMkdir:
+			err = editor.Mkdir(op.Path)
+		case TreeOpMove:
+			err = editor.Move(op.Path, op.NewPath)
+		default:
+			err = ErrInvalidTreeOp
+		}
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	return editor.Commit()
+}
+
+// Node of the directory tree being edited, directory nodes load their
+// children on first access only so that untouched subtrees are never read
+type treeNode struct {
+	entry    DirEntry             // Entry describing this node in the parent directory
+	children map[string]*treeNode // Children of a directory node, nil if not yet loaded
+	modified bool                 // Flag indicating whether the directory blob must be regenerated
+}
+
+// TreeEditor performs copy-on-write modifications of a directory tree.
+//
+// Only directories on paths to modified entries are rewritten when
+// committing changes, all other subtrees are shared with the original tree.
+type TreeEditor struct {
+
+	// Cipher factory, default one is used if nil
+	CipherFactory cipherfactory.Factory
+
+	// Convergence secret used when writing directory blobs
+	ConvergenceSecret []byte
+
+	storage BlobStorage
+	root    *treeNode
+}
+
+// Create new tree editor working on a tree with given root, empty bid
+// starts with an empty tree
+func NewTreeEditor(storage BlobStorage, bid, key string) *TreeEditor {
+	root := &treeNode{
+		entry: DirEntry{Bid: bid, Key: key, Kind: EntryKindDir},
+	}
+	if bid == "" {
+		root.children = make(map[string]*treeNode)
+		root.modified = true
+	}
+	return &TreeEditor{storage: storage, root: root}
+}
+
+// Split the path into a list of names
+func splitTreePath(path string) ([]string, error) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil, nil
+	}
+	names := strings.Split(path, "/")
+	for _, name := range names {
+		if name == "" || name == "." || name == ".." {
+			return nil, ErrInvalidTreePath
+		}
+	}
+	return names, nil
+}
+
+// Make sure the children of a directory node are loaded
+func (e *TreeEditor) loadChildren(node *treeNode) error {
+
+	if node.children != nil {
+		return nil
+	}
+
+	entries, err := loadDirEntries(e.storage, e.CipherFactory, &node.entry)
+	if err != nil {
+		return err
+	}
+
+	children := make(map[string]*treeNode)
+	for _, entry := range entries {
+		children[entry.Name] = &treeNode{entry: entry}
+	}
+
+	node.children = children
+	return nil
+}
+
+// Resolve the directory for given list of names without modifying the
+// tree, returns nodes on the path starting with the root. If missing
+// directories are allowed, only the existing part of the path is returned.
+func (e *TreeEditor) resolveDir(names []string, allowMissing bool) ([]*treeNode, error) {
+
+	node := e.root
+	path := []*treeNode{node}
+	for _, name := range names {
+		if err := e.loadChildren(node); err != nil {
+			return nil, err
+		}
+		child, ok := node.children[name]
+		if !ok {
+			if !allowMissing {
+				return nil, ErrTreePathNotFound
+			}
+			return path, nil
+		}
+		node = child
+		path = append(path, node)
+	}
+	if err := e.loadChildren(node); err != nil {
+		return nil, err
+	}
+
+	return path, nil
+}
+
+// Mark all directories on the path as modified
+func markModified(path []*treeNode) {
+	for _, n := range path {
+		n.modified = true
+	}
+}
+
+// Find the directory node for given list of names, all directories on the
+// path will be marked as modified. Missing directories are created if the
+// create flag is set.
+func (e *TreeEditor) findDir(names []string, create bool) (*treeNode, error) {
+
+	path, err := e.resolveDir(names, create)
+	if err != nil {
+		return nil, err
+	}
+
+	node := path[len(path)-1]
+	for _, name := range names[len(path)-1:] {
+		child := &treeNode{
+			entry:    DirEntry{Name: name, Kind: EntryKindDir},
+			children: make(map[string]*treeNode),
+		}
+		node.children[name] = child
+		node = child
+		path = append(path, node)
+	}
+
+	markModified(path)
+	return node, nil
+}
+
+// Put the entry at given path, replacing any existing entry,
+// missing parent directories are created
+func (e *TreeEditor) Put(path string, entry DirEntry) error {
+	names, err := splitTreePath(path)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return ErrInvalidTreePath
+	}
+
+	parent, err := e.findDir(names[:len(names)-1], true)
+	if err != nil {
+		return err
+	}
+
+	entry.Name = names[len(names)-1]
+	parent.children[entry.Name] = &treeNode{entry: entry}
+	return nil
+}
+
+// Delete the entry at given path
+func (e *TreeEditor) Delete(path string) error {
+	names, err := splitTreePath(path)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return ErrInvalidTreePath
+	}
+
+	parentPath, err := e.resolveDir(names[:len(names)-1], false)
+	if err != nil {
+		return err
+	}
+	parent := parentPath[len(parentPath)-1]
+
+	name := names[len(names)-1]
+	if _, ok := parent.children[name]; !ok {
+		return ErrTreePathNotFound
+	}
+
+	markModified(parentPath)
+	delete(parent.children, name)
+	return nil
+}
+
+// Create a directory at given path including all missing parent
+// directories, it's not an error if the directory already exists
+func (e *TreeEditor) Mkdir(path string) error {
+	names, err := splitTreePath(path)
+	if err != nil {
+		return err
+	}
+	_, err = e.findDir(names, true)
+	return err
+}
+
+// Move an entry to a new path, the destination must not exist,
+// missing parent directories of the destination are created. The tree
+// is not modified if the move fails.
+func (e *TreeEditor) Move(from, to string) error {
+	fromNames, err := splitTreePath(from)
+	if err != nil {
+		return err
+	}
+	toNames, err := splitTreePath(to)
+	if err != nil {
+		return err
+	}
+	if len(fromNames) == 0 || len(toNames) == 0 {
+		return ErrInvalidTreePath
+	}
+
+	// Can not move directory into itself
+	if len(toNames) >= len(fromNames) &&
+		strings.Join(toNames[:len(fromNames)], "/") == strings.Join(fromNames, "/") {
+		return ErrInvalidTreePath
+	}
+
+	fromPath, err := e.resolveDir(fromNames[:len(fromNames)-1], false)
+	if err != nil {
+		return err
+	}
+	fromParent := fromPath[len(fromPath)-1]
+	fromName := fromNames[len(fromNames)-1]
+	node, ok := fromParent.children[fromName]
+	if !ok {
+		return ErrTreePathNotFound
+	}
+
+	// Destination can only exist if all its parents do
+	toParentNames, toName := toNames[:len(toNames)-1], toNames[len(toNames)-1]
+	toPath, err := e.resolveDir(toParentNames, true)
+	if err != nil {
+		return err
+	}
+	if len(toPath) == len(toParentNames)+1 {
+		if _, exists := toPath[len(toPath)-1].children[toName]; exists {
+			return ErrTreePathExists
+		}
+	}
+
+	// All checks passed, can modify the tree now
+	toParent, err := e.findDir(toParentNames, true)
+	if err != nil {
+		return err
+	}
+	markModified(fromPath)
+	delete(fromParent.children, fromName)
+	node.entry.Name = toName
+	toParent.children[toName] = node
+	return nil
+}
+
+// Write all modified directories and return bid and key of the new root,
+// the editor can still be used after the commit
+func (e *TreeEditor) Commit() (bid, key string, err error) {
+	if err = e.commitNode(e.root); err != nil {
+		return "", "", err
+	}
+	return e.root.entry.Bid, e.root.entry.Key, nil
+}
+
+func (e *TreeEditor) commitNode(node *treeNode) error {
+
+	if !node.modified {
+		return nil
+	}
+
+	writer := DirBlobWriter{
+		Storage:           e.storage,
+		CipherFactory:     e.CipherFactory,
+		ConvergenceSecret: e.ConvergenceSecret,
+	}
+	for _, child := range node.children {
+		if err := e.commitNode(child); err != nil {
+			return err
+		}
+		if err := writer.AddEntry(child.entry); err != nil {
+			return err
+		}
+	}
+
+	bid, key, err := writer.Finalize()
+	if err != nil {
+		return err
+	}
+
+	node.entry.Bid, node.entry.Key = bid, key
+	node.modified = false
+	return nil
+}
@@ -0,0 +1,196 @@
+package blobstore
+
+import (
+	"testing"
+)
+
+// Read the whole tree into a map of path -> entry
+func readTree(t *testing.T, storage BlobStorage, bid, key, prefix string, result map[string]DirEntry) map[string]DirEntry {
+	if result == nil {
+		result = make(map[string]DirEntry)
+	}
+	for name, entry := range readDirEntries(t, storage, bid, key) {
+		result[prefix+name] = entry
+		if entry.Kind == EntryKindDir {
+			readTree(t, storage, entry.Bid, entry.Key, prefix+name+"/", result)
+		}
+	}
+	return result
+}
+
+func fileEntry(bid string) DirEntry {
+	return DirEntry{MimeType: "text/plain", Bid: bid, Key: "key" + bid, Kind: EntryKindFile}
+}
+
+func genTestTree(t *testing.T) (BlobStorage, string, string) {
+	storage := NewMemoryBlobStorage()
+	bid, key, err := UpdateTree(storage, "", "", []TreeOp{
+		{Type: TreeOpPut, Path: "a/b/f1", Entry: fileEntry("f1")},
+		{Type: TreeOpPut, Path: "a/f2", Entry: fileEntry("f2")},
+		{Type: TreeOpPut, Path: "/x/f3/", Entry: fileEntry("f3")},
+		{Type: TreeOpMkdir, Path: "empty"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage, bid, key
+}
+
+func TestTreeCreation(t *testing.T) {
+
+	storage, bid, key := genTestTree(t)
+
+	tree := readTree(t, storage, bid, key, "", nil)
+	for path, kind := range map[string]EntryKind{
+		"a":      EntryKindDir,
+		"a/b":    EntryKindDir,
+		"a/b/f1": EntryKindFile,
+		"a/f2":   EntryKindFile,
+		"x":      EntryKindDir,
+		"x/f3":   EntryKindFile,
+		"empty":  EntryKindDir,
+	} {
+		entry, ok := tree[path]
+		if !ok {
+			t.Fatalf("Missing path: %v", path)
+		}
+		if entry.Kind != kind {
+			t.Fatalf("Invalid entry kind for path: %v", path)
+		}
+	}
+	if len(tree) != 7 {
+		t.Fatalf("Invalid number of entries in the tree: %v", len(tree))
+	}
+}
+
+func TestTreeSharedSubtrees(t *testing.T) {
+
+	storage, bid, key := genTestTree(t)
+	before := readTree(t, storage, bid, key, "", nil)
+
+	bid2, key2, err := UpdateTree(storage, bid, key, []TreeOp{
+		{Type: TreeOpPut, Path: "a/b/f1", Entry: fileEntry("f1new")},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bid2 == bid {
+		t.Fatal("Root not rewritten")
+	}
+	after := readTree(t, storage, bid2, key2, "", nil)
+
+	for _, path := range []string{"a", "a/b", "a/b/f1"} {
+		if before[path].Bid == after[path].Bid {
+			t.Fatalf("Entry not updated: %v", path)
+		}
+	}
+	for _, path := range []string{"a/f2", "x", "x/f3", "empty"} {
+		b, a := before[path], after[path]
+		if !b.Equal(&a) {
+			t.Fatalf("Untouched entry changed: %v", path)
+		}
+	}
+
+	// No changes must give the same root
+	bid3, key3, err := UpdateTree(storage, bid, key, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bid3 != bid || key3 != key {
+		t.Fatal("Empty update changed the root")
+	}
+}
+
+func TestTreeDeleteMove(t *testing.T) {
+
+	storage, bid, key := genTestTree(t)
+
+	bid, key, err := UpdateTree(storage, bid, key, []TreeOp{
+		{Type: TreeOpDelete, Path: "a/f2"},
+		{Type: TreeOpMove, Path: "a/b", NewPath: "x/y/b"},
+		{Type: TreeOpDelete, Path: "empty"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := readTree(t, storage, bid, key, "", nil)
+	for _, path := range []string{"a", "x", "x/f3", "x/y", "x/y/b", "x/y/b/f1"} {
+		if _, ok := tree[path]; !ok {
+			t.Fatalf("Missing path: %v", path)
+		}
+	}
+	if len(tree) != 6 {
+		t.Fatalf("Invalid number of entries in the tree: %v", len(tree))
+	}
+}
+
+func TestTreeErrors(t *testing.T) {
+
+	storage, bid, key := genTestTree(t)
+
+	for _, test := range []struct {
+		op  TreeOp
+		err error
+	}{
+		{TreeOp{Type: TreeOpDelete, Path: "missing"}, ErrTreePathNotFound},
+		{TreeOp{Type: TreeOpDelete, Path: "missing/f"}, ErrTreePathNotFound},
+		{TreeOp{Type: TreeOpDelete, Path: ""}, ErrInvalidTreePath},
+		{TreeOp{Type: TreeOpDelete, Path: "a/../x"}, ErrInvalidTreePath},
+		{TreeOp{Type: TreeOpPut, Path: "a/f2/f", Entry: fileEntry("f")}, ErrNotADirectory},
+		{TreeOp{Type: TreeOpMkdir, Path: "x/f3"}, ErrNotADirectory},
+		{TreeOp{Type: TreeOpMove, Path: "a", NewPath: "x"}, ErrTreePathExists},
+		{TreeOp{Type: TreeOpMove, Path: "a", NewPath: "a/b/c"}, ErrInvalidTreePath},
+		{TreeOp{Type: TreeOpMove, Path: "missing", NewPath: "z"}, ErrTreePathNotFound},
+		{TreeOp{Type: -1}, ErrInvalidTreeOp},
+	} {
+		_, _, err := UpdateTree(storage, bid, key, []TreeOp{test.op}, nil)
+		if err != test.err {
+			t.Errorf("Invalid error for operation %v on '%v', expected: %v, got: %v",
+				test.op.Type, test.op.Path, test.err, err)
+		}
+	}
+}
+
+// Check that no node of the loaded part of the tree is marked as modified
+func checkNotModified(t *testing.T, node *treeNode, path string) {
+	if node.modified {
+		t.Fatalf("Node marked as modified: '%v'", path)
+	}
+	for name, child := range node.children {
+		checkNotModified(t, child, path+"/"+name)
+	}
+}
+
+func TestTreeFailedOpsDontModify(t *testing.T) {
+
+	storage, bid, key := genTestTree(t)
+	editor := NewTreeEditor(storage, bid, key)
+
+	for _, test := range []struct {
+		err error
+		op  func() error
+	}{
+		{ErrTreePathNotFound, func() error { return editor.Delete("a/b/missing") }},
+		{ErrTreePathNotFound, func() error { return editor.Delete("a/missing/f") }},
+		{ErrTreePathExists, func() error { return editor.Move("a/f2", "x/f3") }},
+		{ErrTreePathNotFound, func() error { return editor.Move("a/missing", "n/m/f") }},
+		{ErrNotADirectory, func() error { return editor.Move("a/f2", "x/f3/n/f") }},
+	} {
+		if err := test.op(); err != test.err {
+			t.Fatalf("Invalid error, expected: %v, got: %v", test.err, err)
+		}
+		checkNotModified(t, editor.root, "")
+	}
+	if _, ok := editor.root.children["n"]; ok {
+		t.Fatal("Failed move created destination directories")
+	}
+
+	newBid, newKey, err := editor.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newBid != bid || newKey != key {
+		t.Fatal("Failed operations changed the root")
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blobstore
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Conflict found while merging directory trees, an entry that does not
+// exist in given tree is represented by a zero value with empty Bid
+type MergeConflict struct {
+	Path               string // Path of the conflicting entry relative to the root
+	Base, Ours, Theirs DirEntry
+}
+
+// Resolver of merge conflicts, it returns the list of entries that will be
+// put in the merged directory in place of the conflicting one, the list may
+// be empty to remove the entry. The nameTaken function can be used to check
+// whether the name is already used by other entry in the merged directory.
+type MergeResolver func(conflict MergeConflict, nameTaken func(name string) bool) ([]DirEntry, error)
+
+// Resolve conflicts by taking our version
+func MergeOurs(conflict MergeConflict, nameTaken func(name string) bool) ([]DirEntry, error) {
+	if conflict.Ours.Bid == "" {
+		return nil, nil
+	}
+	return []DirEntry{conflict.Ours}, nil
+}
+
+// Resolve conflicts by taking their version
+func MergeTheirs(conflict MergeConflict, nameTaken func(name string) bool) ([]DirEntry, error) {
+	if conflict.Theirs.Bid == "" {
+		return nil, nil
+	}
+	return []DirEntry{conflict.Theirs}, nil
+}
+
+// Resolve conflicts by keeping both versions, their version is renamed
+// by adding a ".theirs" suffix (and a number if needed) to the name
+func MergeKeepBoth(conflict MergeConflict, nameTaken func(name string) bool) ([]DirEntry, error) {
+	if conflict.Ours.Bid == "" {
+		return MergeTheirs(conflict, nameTaken)
+	}
+	if conflict.Theirs.Bid == "" {
+		return MergeOurs(conflict, nameTaken)
+	}
+
+	theirs := conflict.Theirs
+	theirs.Name += ".theirs"
+	for i := 1; nameTaken(theirs.Name) || theirs.Name == conflict.Ours.Name; i++ {
+		theirs.Name = conflict.Theirs.Name + ".theirs." + strconv.Itoa(i)
+	}
+	return []DirEntry{conflict.Ours, theirs}, nil
+}
+
+type treeMerge struct {
+	storage   BlobStorage
+	opts      *TreeOptions
+	resolver  MergeResolver
+	conflicts []MergeConflict
+}
+
+// Directory merged in memory, it's written once all conflicts are known
+type mergedDir struct {
+	dir     DirEntry // Entry of the directory with metadata taken from our side
+	items   []mergedItem
+	pending []MergeConflict // Conflicts resolved when the directory is written
+}
+
+// Automatically merged entry of the directory
+type mergedItem struct {
+	entry DirEntry
+	dir   *mergedDir // Merged subdirectory that must be written first, nil if unchanged
+}
+
+// Merge two directory trees (ours and theirs) against their common
+// ancestor (base). Changes done on one side only are merged automatically,
+// subtrees are compared by bids only. If the resolver is nil, conflicts
+// are returned along with ErrMergeConflict and nothing is written to the
+// storage, otherwise the resolved tree is written and the list of conflicts
+// is returned for information purposes. Options can be nil.
+func MergeTrees(
+	storage BlobStorage,
+	baseBid, baseKey, oursBid, oursKey, theirsBid, theirsKey string,
+	resolver MergeResolver,
+	opts *TreeOptions,
+) (
+	bid, key string,
+	conflicts []MergeConflict,
+	err error,
+) {
+
+	// Trivial cases first
+	switch {
+	case oursBid == theirsBid || theirsBid == baseBid:
+		return oursBid, oursKey, nil, nil
+	case oursBid == baseBid:
+		return theirsBid, theirsKey, nil, nil
+	}
+
+	m := &treeMerge{storage: storage, opts: opts, resolver: resolver}
+	base := &DirEntry{Bid: baseBid, Key: baseKey, Kind: EntryKindDir}
+	ours := &DirEntry{Bid: oursBid, Key: oursKey, Kind: EntryKindDir}
+	theirs := &DirEntry{Bid: theirsBid, Key: theirsKey, Kind: EntryKindDir}
+
+	baseEntries, _, err := probeDirEntries(storage, opts.cipherFactory(), base)
+	if err != nil {
+		return "", "", nil, err
+	}
+	oursEntries, err := loadDirEntries(storage, opts.cipherFactory(), ours)
+	if err != nil {
+		return "", "", nil, err
+	}
+	theirsEntries, err := loadDirEntries(storage, opts.cipherFactory(), theirs)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	merged, err := m.mergeDirs("", ours, baseEntries, oursEntries, theirsEntries)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if resolver == nil && len(m.conflicts) > 0 {
+		return "", "", m.conflicts, ErrMergeConflict
+	}
+
+	written, err := m.writeDir(merged)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return written.Bid, written.Key, m.conflicts, nil
+}
+
+// Merge content of directories, conflicts are queued for the resolver
+// which is called once the directory is written
+func (m *treeMerge) mergeDirs(prefix string, ours *DirEntry, baseEntries, oursEntries, theirsEntries []DirEntry) (*mergedDir, error) {
+
+	// Index all entries by name
+	index := func(entries []DirEntry) map[string]*DirEntry {
+		ret := make(map[string]*DirEntry)
+		for i := range entries {
+			ret[entries[i].Name] = &entries[i]
+		}
+		return ret
+	}
+	baseMap, oursMap, theirsMap := index(baseEntries), index(oursEntries), index(theirsEntries)
+
+	var names []string
+	for _, entries := range []map[string]*DirEntry{baseMap, oursMap, theirsMap} {
+		for name := range entries {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	merged := &mergedDir{dir: *ours}
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+
+		item, conflict, err := m.mergeEntry(prefix+name, baseMap[name], oursMap[name], theirsMap[name])
+		if err != nil {
+			return nil, err
+		}
+		if conflict != nil {
+			m.conflicts = append(m.conflicts, *conflict)
+			merged.pending = append(merged.pending, *conflict)
+			continue
+		}
+		if item != nil {
+			merged.items = append(merged.items, *item)
+		}
+	}
+
+	return merged, nil
+}
+
+// Write the merged directory along with merged subdirectories, returns
+// the entry of the written directory
+func (m *treeMerge) writeDir(merged *mergedDir) (*DirEntry, error) {
+
+	// First pass - automatically merged entries, conflicts are resolved
+	// in the second pass so that the resolver does know all names
+	writer := DirBlobWriter{
+		Storage:           m.storage,
+		CipherFactory:     m.opts.cipherFactory(),
+		ConvergenceSecret: m.opts.convergenceSecret(),
+	}
+	for _, item := range merged.items {
+		entry := item.entry
+		if item.dir != nil {
+			written, err := m.writeDir(item.dir)
+			if err != nil {
+				return nil, err
+			}
+			entry = *written
+		}
+		if err := writer.AddEntry(entry); err != nil {
+			return nil, err
+		}
+	}
+
+	// Second pass - resolve conflicts
+	if m.resolver != nil {
+		nameTaken := func(name string) bool {
+			if _, ok := writer.GetEntry(name); ok {
+				return true
+			}
+			for _, c := range merged.pending {
+				if c.Ours.Name == name || c.Theirs.Name == name {
+					return true
+				}
+			}
+			return false
+		}
+		for _, conflict := range merged.pending {
+			entries, err := m.resolver(conflict, nameTaken)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if err = writer.AddEntry(entry); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	bid, key, err := writer.Finalize()
+	if err != nil {
+		return nil, err
+	}
+
+	written := merged.dir
+	written.Bid, written.Key = bid, key
+	return &written, nil
+}
+
+// Merge single entry, returns merged entry (nil if it should be removed)
+// or a conflict
+func (m *treeMerge) mergeEntry(path string, base, ours, theirs *DirEntry) (*mergedItem, *MergeConflict, error) {
+
+	equal := func(a, b *DirEntry) bool {
+		if a == nil || b == nil {
+			return a == b
+		}
+		return a.Equal(b)
+	}
+
+	// Changes on one side only
+	switch {
+	case equal(ours, theirs), equal(base, theirs):
+		if ours == nil {
+			return nil, nil, nil
+		}
+		return &mergedItem{entry: *ours}, nil, nil
+	case equal(base, ours):
+		if theirs == nil {
+			return nil, nil, nil
+		}
+		return &mergedItem{entry: *theirs}, nil, nil
+	}
+
+	// Both sides changed, only directories can be merged deeper,
+	// entries loaded while probing are used for the merge
+	if ours != nil && theirs != nil {
+		oursEntries, oursIsDir, err := probeDirEntries(m.storage, m.opts.cipherFactory(), ours)
+		if err != nil {
+			return nil, nil, err
+		}
+		theirsEntries, theirsIsDir, err := probeDirEntries(m.storage, m.opts.cipherFactory(), theirs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if oursIsDir && theirsIsDir {
+			var baseEntries []DirEntry
+			if base != nil {
+				if baseEntries, _, err = probeDirEntries(m.storage, m.opts.cipherFactory(), base); err != nil {
+					return nil, nil, err
+				}
+			}
+			merged, err := m.mergeDirs(path+"/", ours, baseEntries, oursEntries, theirsEntries)
+			if err != nil {
+				return nil, nil, err
+			}
+			return &mergedItem{entry: merged.dir, dir: merged}, nil, nil
+		}
+	}
+
+	conflict := &MergeConflict{Path: path}
+	if base != nil {
+		conflict.Base = *base
+	}
+	if ours != nil {
+		conflict.Ours = *ours
+	}
+	if theirs != nil {
+		conflict.Theirs = *theirs
+	}
+	return nil, conflict, nil
+}
@@ -0,0 +1,116 @@
+package blobstore
+
+import (
+	"testing"
+)
+
+func genMergeTestTrees(t *testing.T) (storage BlobStorage, base, ours, theirs [2]string) {
+
+	storage, base[0], base[1] = genTestTree(t)
+
+	var err error
+	ours[0], ours[1], err = UpdateTree(storage, base[0], base[1], []TreeOp{
+		{Type: TreeOpPut, Path: "a/b/f1", Entry: fileEntry("f1ours")},
+		{Type: TreeOpPut, Path: "a/b/o", Entry: fileEntry("o")},
+		{Type: TreeOpPut, Path: "c", Entry: fileEntry("cours")},
+		{Type: TreeOpDelete, Path: "x/f3"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	theirs[0], theirs[1], err = UpdateTree(storage, base[0], base[1], []TreeOp{
+		{Type: TreeOpPut, Path: "a/b/f1", Entry: fileEntry("f1theirs")},
+		{Type: TreeOpPut, Path: "a/b/t", Entry: fileEntry("t")},
+		{Type: TreeOpPut, Path: "c", Entry: fileEntry("ctheirs")},
+		{Type: TreeOpPut, Path: "a/f2", Entry: fileEntry("f2theirs")},
+		{Type: TreeOpDelete, Path: "empty"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func TestTreeMergeConflicts(t *testing.T) {
+
+	storage, base, ours, theirs := genMergeTestTrees(t)
+	blobs := len(storage.(*memoryBlobStorage).blobs)
+
+	bid, _, conflicts, err := MergeTrees(storage, base[0], base[1], ours[0], ours[1], theirs[0], theirs[1], nil, nil)
+	if err != ErrMergeConflict {
+		t.Fatalf("Invalid error for conflicting merge: %v", err)
+	}
+	if bid != "" {
+		t.Fatal("Got merged tree although conflicts were not resolved")
+	}
+	if len(storage.(*memoryBlobStorage).blobs) != blobs {
+		t.Fatal("Blobs written although conflicts were not resolved")
+	}
+	if len(conflicts) != 2 {
+		t.Fatalf("Invalid number of conflicts: %v", len(conflicts))
+	}
+	if c := conflicts[0]; c.Path != "a/b/f1" || c.Base.Bid != "f1" || c.Ours.Bid != "f1ours" || c.Theirs.Bid != "f1theirs" {
+		t.Fatalf("Invalid conflict: %v", c.Path)
+	}
+	if c := conflicts[1]; c.Path != "c" || c.Base.Bid != "" || c.Ours.Bid != "cours" || c.Theirs.Bid != "ctheirs" {
+		t.Fatalf("Invalid conflict: %v", c.Path)
+	}
+}
+
+func TestTreeMergeResolvers(t *testing.T) {
+
+	storage, base, ours, theirs := genMergeTestTrees(t)
+
+	for _, test := range []struct {
+		resolver MergeResolver
+		expected map[string]string
+	}{
+		{MergeOurs, map[string]string{"a/b/f1": "f1ours", "c": "cours"}},
+		{MergeTheirs, map[string]string{"a/b/f1": "f1theirs", "c": "ctheirs"}},
+		{MergeKeepBoth, map[string]string{
+			"a/b/f1": "f1ours", "a/b/f1.theirs": "f1theirs",
+			"c": "cours", "c.theirs": "ctheirs"}},
+	} {
+		bid, key, conflicts, err := MergeTrees(storage, base[0], base[1], ours[0], ours[1], theirs[0], theirs[1], test.resolver, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(conflicts) != 2 {
+			t.Fatalf("Invalid number of conflicts: %v", len(conflicts))
+		}
+
+		tree := readTree(t, storage, bid, key, "", nil)
+
+		// Non-conflicting changes from both sides
+		expected := map[string]string{"a/b/o": "o", "a/b/t": "t", "a/f2": "f2theirs"}
+		for path, bid := range test.expected {
+			expected[path] = bid
+		}
+		for path, bid := range expected {
+			if tree[path].Bid != bid {
+				t.Fatalf("Invalid entry at %v, expected bid: %v, got: %v", path, bid, tree[path].Bid)
+			}
+		}
+		for _, path := range []string{"x/f3", "empty"} {
+			if _, ok := tree[path]; ok {
+				t.Fatalf("Removed entry found: %v", path)
+			}
+		}
+	}
+}
+
+func TestTreeMergeTrivial(t *testing.T) {
+
+	storage, base, ours, _ := genMergeTestTrees(t)
+
+	bid, key, conflicts, err := MergeTrees(storage, base[0], base[1], ours[0], ours[1], base[0], base[1], nil, nil)
+	if err != nil || len(conflicts) != 0 || bid != ours[0] || key != ours[1] {
+		t.Fatal("Merge with unchanged side must return the other side")
+	}
+	bid, key, conflicts, err = MergeTrees(storage, base[0], base[1], base[0], base[1], ours[0], ours[1], nil, nil)
+	if err != nil || len(conflicts) != 0 || bid != ours[0] || key != ours[1] {
+		t.Fatal("Merge with unchanged side must return the other side")
+	}
+}
@@ -5,31 +5,96 @@
 package blobstore
 
 import (
-	"bytes"
-	"crypto/sha512"
-	"encoding/hex"
+	"github.com/cinode/golib/cipherfactory"
 	"io"
 )
 
-func createHashValidatedBlobFromReaderGenerator(readerGenerator func() io.Reader, storage BlobStorage) (bid string, key string, err error) {
+// Create hash validated blob from given source. The content is read twice,
+// first to generate the key and then to encrypt the data. Sources that can
+// seek are rewound to the position they started at, any other source is
+// spooled while generating the key.
+// Encrypted data is streamed directly to the storage if it supports
+// deferred blob ids, otherwise it's spooled until the blob id is known.
+//
+// Unlike signed blobs, there's no random IV here - the key is derived from
+// the content so the keystream is reused for identical content only, which
+// yields identical blobs that can be deduplicated.
+func createHashValidatedBlob(source io.Reader, storage BlobStorage, cf cipherfactory.Factory, convergenceSecret []byte) (bid string, key string, err error) {
+
+	cf = getCipherFactory(cf)
 
 	// Generate the key
-	hasher := sha512.New()
-	io.Copy(hasher, readerGenerator())
+	hasher, err := createKeySourceHasher(cf, convergenceSecret)
+	if err != nil {
+		return
+	}
+	seeker, canSeek := source.(io.ReadSeeker)
+	var plainSpool spool
+	var start int64
+	if canSeek {
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return
+		}
+		_, err = io.Copy(hasher, source)
+	} else {
+		defer plainSpool.Close()
+		_, err = io.Copy(io.MultiWriter(hasher, &plainSpool), source)
+	}
+	if err != nil {
+		return
+	}
 	keySource := hasher.Sum(nil)
+	if canSeek {
+		if _, err = seeker.Seek(start, io.SeekStart); err != nil {
+			return
+		}
+	} else {
+		source = plainSpool.Reader()
+	}
+
+	// Prepare the destination for encrypted data
+	var deferredWriter DeferredBlobWriter
+	var encryptedSpool spool
+	var output io.Writer
+	if deferredStorage, ok := storage.(DeferredBlobStorage); ok {
+		if deferredWriter, err = deferredStorage.NewDeferredBlobWriter(); err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				deferredWriter.Cancel()
+			}
+		}()
+		if _, err = deferredWriter.Write([]byte{validationMethodHash}); err != nil {
+			return
+		}
+		output = deferredWriter
+	} else {
+		defer encryptedSpool.Close()
+		output = &encryptedSpool
+	}
 
-	// Generate the encrypted content
-	encryptedBuffer := bytes.Buffer{}
-	encryptedWriter, key, err := createEncryptor(keySource, nil, &encryptedBuffer)
+	// Generate the encrypted content along with the blob id
+	bidHasher, err := cipherfactory.NewBIDHasher(cf)
+	if err != nil {
+		return
+	}
+	encryptedWriter, key, err := cipherfactory.NewEncryptor(cf, keySource, nil, io.MultiWriter(output, bidHasher))
 	if err != nil {
 		return
 	}
-	io.Copy(encryptedWriter, readerGenerator())
+	if _, err = io.Copy(encryptedWriter, source); err != nil {
+		return
+	}
+	if err = encryptedWriter.Close(); err != nil {
+		return
+	}
+	bid = bidHasher.BID()
 
-	// Generate blob id
-	hasher.Reset()
-	io.Copy(hasher, bytes.NewReader(encryptedBuffer.Bytes()))
-	bid = hex.EncodeToString(hasher.Sum(nil))
+	if deferredWriter != nil {
+		err = deferredWriter.Finalize(bid)
+		return
+	}
 
 	// Finally generate the blob itself
 	blobWriter, err := storage.NewBlobWriter(bid)
@@ -44,7 +109,7 @@ func createHashValidatedBlobFromReaderGenerator(readerGenerator func() io.Reader
 	if _, err = blobWriter.Write([]byte{validationMethodHash}); err != nil {
 		return
 	}
-	if _, err = io.Copy(blobWriter, &encryptedBuffer); err != nil {
+	if _, err = io.Copy(blobWriter, encryptedSpool.Reader()); err != nil {
 		return
 	}
 	if err = blobWriter.Finalize(); err != nil {
@@ -55,13 +120,13 @@ func createHashValidatedBlobFromReaderGenerator(readerGenerator func() io.Reader
 	return
 }
 
-func createReaderForHashBlobData(reader io.Reader, bid, key string) (rawReader io.Reader, err error) {
+func createReaderForHashBlobData(reader io.Reader, bid, key string, cf cipherfactory.Factory) (rawReader io.Reader, err error) {
 	// TODO: We could validate the content while it's being read - generate the hash
 	// and throw some error when reaching EOF and having invalid hash
-	return createDecryptor(key, nil, reader)
+	return getCipherFactory(cf).CreateDecryptor(key, nil, reader)
 }
 
-func createReaderForHashBlob(bid string, key string, storage BlobStorage) (rawReader io.Reader, err error) {
+func createReaderForHashBlob(bid string, key string, storage BlobStorage, cf cipherfactory.Factory) (rawReader io.Reader, err error) {
 
 	// Get the reader
 	encryptedReader, err := storage.NewBlobReader(bid)
@@ -79,5 +144,5 @@ func createReaderForHashBlob(bid string, key string, storage BlobStorage) (rawRe
 	}
 
 	// Get the encryptor
-	return createReaderForHashBlobData(encryptedReader, bid, key)
+	return createReaderForHashBlobData(encryptedReader, bid, key, cf)
 }
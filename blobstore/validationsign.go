@@ -2,20 +2,21 @@ package blobstore
 
 import (
 	"bytes"
-	"crypto"
-	"crypto/rsa"
+	"crypto/rand"
 	"crypto/x509"
-	"encoding/hex"
+	"github.com/cinode/golib/cipherfactory"
 	"io"
 )
 
-type privateKey *rsa.PrivateKey
-
+// Create signed blob, the signature type is selected by the type of the
+// signing key, RSA, Ed25519 and ECDSA P-256 keys are supported. The data
+// is encrypted with the key derived from the read key of the bundle.
 func createSignValidatedBlobFromReaderGenerator(
 	readerGenerator func() io.Reader,
-	privKey privateKey,
+	keys *SignedBlobKeys,
 	dataVersion int64,
 	storage BlobStorage,
+	cf cipherfactory.Factory,
 ) (
 	// Return values
 	bidRet string,
@@ -23,37 +24,68 @@ func createSignValidatedBlobFromReaderGenerator(
 	err error,
 ) {
 
-	// We're using hash of the private key to create the encryption data key
-	dataKey := createDataHash(x509.MarshalPKCS1PrivateKey(privKey))
+	cf = getCipherFactory(cf)
+
+	if len(keys.readKey) == 0 {
+		return "", "", ErrInsufficientKeySource
+	}
+
+	privKey := keys.signingKey
+	scheme, err := getSignatureScheme(privKey.Public())
+	if err != nil {
+		return
+	}
+
+	// The encryption data key does only depend on the read key
+	dataKey, err := createDataHash(cf, keys.readKey)
+	if err != nil {
+		return
+	}
 
-	// Version + encrypted data buffer
+	// Random nonce is used as IV, the key is the same for all versions
+	// thus the keystream must not depend on the version only
+	nonce := make([]byte, signedBlobNonceLength)
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return
+	}
+
+	// Version + nonce + encrypted data buffer
 	verDataBuffer := bytes.Buffer{}
 	serializeInt(dataVersion, &verDataBuffer)
+	serializeBuffer(nonce, &verDataBuffer)
 
-	// Encrypt the data, note we're using the version bytes as IV
-	encryptedWriter, key, err := createEncryptor(dataKey, verDataBuffer.Bytes(), &verDataBuffer)
+	// Encrypt the data
+	encryptedWriter, key, err := cipherfactory.NewEncryptor(cf, dataKey, nonce, &verDataBuffer)
 	if err != nil {
 		return
 	}
 	io.Copy(encryptedWriter, readerGenerator())
+	if err = encryptedWriter.Close(); err != nil {
+		return
+	}
 
-	// Calculate the signature of version + encrypted data blob
-	signature, err := rsa.SignPKCS1v15(
-		nil, privKey,
-		crypto.SHA512,
-		createDataHash(verDataBuffer.Bytes()))
+	// Calculate the signature of version + nonce + encrypted data blob,
+	// the signature scheme does not depend on the cipher factory
+	signatureHasher := scheme.hash.New()
+	signatureHasher.Write(verDataBuffer.Bytes())
+	signature, err := privKey.Sign(rand.Reader, signatureHasher.Sum(nil), scheme.signerOpts)
 	if err != nil {
 		return
 	}
 
 	// Generate the public key blob
-	pubKey, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	pubKey, err := x509.MarshalPKIXPublicKey(privKey.Public())
 	if err != nil {
 		return
 	}
 
 	// Generate the BID from the public key
-	bid := hex.EncodeToString(createDataHash(pubKey))
+	bidHasher, err := cipherfactory.NewBIDHasher(cf)
+	if err != nil {
+		return
+	}
+	bidHasher.Write(pubKey)
+	bid := bidHasher.BID()
 
 	// Open the blob for writing
 	blobWriter, err := storage.NewBlobWriter(bid)
@@ -68,7 +100,7 @@ func createSignValidatedBlobFromReaderGenerator(
 
 	// Write blob header (without version)
 	header := bytes.Buffer{}
-	header.WriteByte(validationMethodSign)
+	header.WriteByte(validationMethodSignV2)
 	serializeBuffer(pubKey, &header)
 	serializeBuffer(signature, &header)
 
@@ -76,7 +108,7 @@ func createSignValidatedBlobFromReaderGenerator(
 		return
 	}
 
-	// Write the version and encrypted data
+	// Write the version, nonce and encrypted data
 	if _, err = blobWriter.Write(verDataBuffer.Bytes()); err != nil {
 		return
 	}
@@ -90,7 +122,15 @@ func createSignValidatedBlobFromReaderGenerator(
 	return bid, key, nil
 }
 
-func createReaderForSignedBlobData(reader io.Reader, bid, key string) (rawReader io.Reader, err error) {
+// Create reader for signed blob data following the validation method,
+// legacy blobs without the nonce use the version as IV
+func createReaderForSignedBlobData(reader io.Reader, validationMethod int64, bid, key string, cf cipherfactory.Factory) (rawReader io.Reader, err error) {
+
+	if validationMethod != validationMethodSign && validationMethod != validationMethodSignV2 {
+		return nil, ErrInvalidValidationMethod
+	}
+
+	cf = getCipherFactory(cf)
 
 	// Grab the public key blob
 	pubkey, err := deserializeBuffer(reader, maxSanePubKeyLength)
@@ -99,7 +139,12 @@ func createReaderForSignedBlobData(reader io.Reader, bid, key string) (rawReader
 	}
 
 	// Validate blob id agains public key
-	if hex.EncodeToString(createDataHash(pubkey)) != bid {
+	bidHasher, err := cipherfactory.NewBIDHasherFor(cf, bid)
+	if err != nil {
+		return
+	}
+	bidHasher.Write(pubkey)
+	if bidHasher.BID() != bid {
 		return nil, ErrInvalidPublicKeyBid
 	}
 
@@ -108,9 +153,9 @@ func createReaderForSignedBlobData(reader io.Reader, bid, key string) (rawReader
 	if err != nil {
 		return
 	}
-	pubKeyParsed, ok := pubKeyParsedRaw.(*rsa.PublicKey)
-	if !ok {
-		return nil, ErrUnknownPublicKeyType
+	scheme, err := getSignatureScheme(pubKeyParsedRaw)
+	if err != nil {
+		return
 	}
 
 	// Read the signature
@@ -125,17 +170,37 @@ func createReaderForSignedBlobData(reader io.Reader, bid, key string) (rawReader
 		return
 	}
 
-	// TODO: Create validating reader that will check the signature when
-	//       we reach EOF
-	_, _ = signature, pubKeyParsed
-
-	// Create the decryptor of the content
+	// Read the nonce
 	verBuffer := bytes.Buffer{}
 	serializeInt(version, &verBuffer)
-	return createDecryptor(key, verBuffer.Bytes(), reader)
+	iv := verBuffer.Bytes()
+	if validationMethod == validationMethodSignV2 {
+		nonce, err := deserializeBuffer(reader, signedBlobNonceLength)
+		if err != nil {
+			return nil, err
+		}
+		if len(nonce) != signedBlobNonceLength {
+			return nil, ErrMalformedSignedBlobNonce
+		}
+		serializeBuffer(nonce, &verBuffer)
+		iv = nonce
+	}
+
+	// The signature is checked once the whole content is read
+	verifyingReader := &signatureVerifyingReader{
+		reader:    reader,
+		hasher:    scheme.hash.New(),
+		scheme:    scheme,
+		pubKey:    pubKeyParsedRaw,
+		signature: signature,
+	}
+	verifyingReader.hasher.Write(verBuffer.Bytes())
+
+	// Create the decryptor of the content
+	return cf.CreateDecryptor(key, iv, verifyingReader)
 }
 
-func createReaderForSignedBlob(bid string, key string, storage BlobStorage) (rawReader io.Reader, err error) {
+func createReaderForSignedBlob(bid string, key string, storage BlobStorage, cf cipherfactory.Factory) (rawReader io.Reader, err error) {
 
 	// Get the reader
 	encryptedReader, err := storage.NewBlobReader(bid)
@@ -148,10 +213,6 @@ func createReaderForSignedBlob(bid string, key string, storage BlobStorage) (raw
 	if err != nil {
 		return
 	}
-	if validationType != validationMethodSign {
-		return nil, ErrInvalidValidationMethod
-	}
-
 	// Get the encryptor
-	return createReaderForSignedBlobData(encryptedReader, bid, key)
+	return createReaderForSignedBlobData(encryptedReader, validationType, bid, key, cf)
 }
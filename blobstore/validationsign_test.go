@@ -2,8 +2,13 @@ package blobstore
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"encoding/hex"
 	//"fmt"
 	"io"
 	"io/ioutil"
@@ -19,6 +24,11 @@ func TestSimpleWriteReadCycle(t *testing.T) {
 		t.Fatal("Could not generate test RSA key")
 	}
 
+	keys, err := NewSignedBlobKeys(privKey, nil)
+	if err != nil {
+		t.Fatal("Could not create key bundle:", err)
+	}
+
 	storage := NewMemoryBlobStorage()
 
 	testData := []byte("Hello world!")
@@ -26,12 +36,12 @@ func TestSimpleWriteReadCycle(t *testing.T) {
 	// Generate the blob
 	bid, key, err := createSignValidatedBlobFromReaderGenerator(func() io.Reader {
 		return bytes.NewReader(testData)
-	}, privKey, 832, storage)
+	}, keys, 832, storage, nil)
 	if err != nil {
 		t.Fatal("Could not create signed blob:", err)
 	}
 
-	reader, err := createReaderForSignedBlob(bid, key, storage)
+	reader, err := createReaderForSignedBlob(bid, key, storage, nil)
 	if err != nil {
 		t.Fatal("Could not create signed blob reader:", err)
 	}
@@ -45,3 +55,163 @@ func TestSimpleWriteReadCycle(t *testing.T) {
 		t.Fatal("Invalid data read from the blob", data, testData)
 	}
 }
+
+func TestSignatureKeyTypes(t *testing.T) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []byte("Hello world!")
+
+	for _, privKey := range []crypto.Signer{rsaKey, ed25519Key, ecdsaKey} {
+
+		keys, err := NewSignedBlobKeys(privKey, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		storage := NewMemoryBlobStorage()
+		bid, key, err := createSignValidatedBlobFromReaderGenerator(func() io.Reader {
+			return bytes.NewReader(testData)
+		}, keys, 1, storage, nil)
+		if err != nil {
+			t.Fatalf("Could not create signed blob for %T: %v", privKey, err)
+		}
+
+		reader, err := createReaderForSignedBlob(bid, key, storage, nil)
+		if err != nil {
+			t.Fatalf("Could not create signed blob reader for %T: %v", privKey, err)
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("Could not read signed blob content for %T: %v", privKey, err)
+		}
+		if !bytes.Equal(data, testData) {
+			t.Fatalf("Invalid data read from the blob for %T", privKey)
+		}
+
+		// Tamper with the content
+		blob := storage.(*memoryBlobStorage).blobs[bid]
+		blob[len(blob)-1] ^= 0x01
+		reader, err = createReaderForSignedBlob(bid, key, storage, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ioutil.ReadAll(reader); err != ErrInvalidSignature {
+			t.Fatalf("Modified blob not detected for %T: %v", privKey, err)
+		}
+	}
+}
+
+func TestSignatureUnknownKeyType(t *testing.T) {
+
+	privKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewSignedBlobKeys(privKey, nil)
+	if err != ErrUnknownPublicKeyType {
+		t.Fatal("Unsupported key type not detected:", err)
+	}
+
+	_, _, err = createSignValidatedBlobFromReaderGenerator(func() io.Reader {
+		return bytes.NewReader([]byte("Hello world!"))
+	}, &SignedBlobKeys{signingKey: privKey, readKey: make([]byte, 64)}, 1, NewMemoryBlobStorage(), nil)
+	if err != ErrUnknownPublicKeyType {
+		t.Fatal("Unsupported key type not detected:", err)
+	}
+}
+
+// Signed blob in the legacy format using the version as IV, created by
+// the original implementation from RSA key with version 7 and content
+// "Legacy data"
+var legacySignedBlob = struct {
+	bid, key, blob string
+}{
+	bid: "f12bca99b41d51829ae35d0e3ea2dcbcd4c789381407599cb83906d963d588b7530c72028cd25e3c7aa915cc01e5a6cc2041467adbb9753c7ddc970c01ff73fc",
+	key: "010861d7183d61ebd5f0691845449c2d967c3660e2e5988c66d3636ffec2b88c5d",
+	blob: "" +
+		"02a20130819f300d06092a864886f70d010101050003818d0030818902818100" +
+		"cdf0fb9220f15b315c2531c8a59c08f7a63b0eb342e9a0ff32799556621b6434" +
+		"f1312679d21e492644ddcbdbd416595a5bf433c2220336b4d14218457b54df1d" +
+		"01e66f72e30078d34645aa8784da7a033d57e497e90adbd788e7c8f28180c926" +
+		"178ee32e92386d8607be3b128218e1d60ebecaf2e2bf3a2be2610cc83bce0a41" +
+		"020301000180019192f67b81f937738cd118356fe4549d473f9cfab53175f351" +
+		"7e1cbb7cbc78d08756f3159dc3fcbea12e6e54a6a7d485312b94897d3b03307e" +
+		"deea13237753393eacdcdcb45678f3e4e0afb236e0adfda7fbb597ae99dfa951" +
+		"cda0ee395b6437dba871925176efc6713b933d7ae1f13a08f7d49638b28921a6" +
+		"17f66360322bdb079a39f5fc34e8f8523a0a72",
+}
+
+func TestSignedBlobNonce(t *testing.T) {
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewSignedBlobKeys(privKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readBlob := func(storage BlobStorage, bid, key string) []byte {
+		reader, err := createReaderForSignedBlob(bid, key, storage, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// Two blobs with the same version must not share the keystream
+	storage1, storage2 := NewMemoryBlobStorage(), NewMemoryBlobStorage()
+	bid, key, err := createSignValidatedBlobFromReaderGenerator(func() io.Reader {
+		return bytes.NewReader([]byte("AAAAAAAAAAAA"))
+	}, keys, 5, storage1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = createSignValidatedBlobFromReaderGenerator(func() io.Reader {
+		return bytes.NewReader([]byte("AAAAAAAAAAAB"))
+	}, keys, 5, storage2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob1 := storage1.(*memoryBlobStorage).blobs[bid]
+	blob2 := storage2.(*memoryBlobStorage).blobs[bid]
+	if blob1[0] != validationMethodSignV2 || blob2[0] != validationMethodSignV2 {
+		t.Fatal("Invalid validation method of new signed blob")
+	}
+	// Plaintexts differ in the last byte only, with the same keystream
+	// all preceding bytes of the ciphertext would be equal
+	if bytes.Equal(blob1[len(blob1)-12:len(blob1)-1], blob2[len(blob2)-12:len(blob2)-1]) {
+		t.Fatal("Keystream reused for blobs with the same version")
+	}
+	if !bytes.Equal(readBlob(storage1, bid, key), []byte("AAAAAAAAAAAA")) ||
+		!bytes.Equal(readBlob(storage2, bid, key), []byte("AAAAAAAAAAAB")) {
+		t.Fatal("Invalid data read from the blob")
+	}
+
+	// Legacy blobs must still be readable
+	legacyStorage := NewMemoryBlobStorage()
+	legacyBlob, _ := hex.DecodeString(legacySignedBlob.blob)
+	putBlob(legacyStorage, legacySignedBlob.bid, legacyBlob)
+	if !bytes.Equal(readBlob(legacyStorage, legacySignedBlob.bid, legacySignedBlob.key), []byte("Legacy data")) {
+		t.Fatal("Invalid data read from the legacy blob")
+	}
+}
@@ -6,4 +6,29 @@ const (
 	cipherAES256                = 0x01
 	cipherAES256Hex             = "01"
 	cipherAES256KeySourceLength = 32
+
+	// AES-256 in GCM mode cipher identification
+	cipherAES256GCM                = 0x02
+	cipherAES256GCMHex             = "02"
+	cipherAES256GCMKeySourceLength = 32
+)
+
+// Cipher types that can be selected for encryption
+const (
+	CipherAES256CFB = cipherAES256
+	CipherAES256GCM = cipherAES256GCM
+)
+
+// Hash types identification
+const (
+	hashSHA512     = 0x01
+	hashSHA256     = 0x02
+	hashBLAKE2b512 = 0x03
+)
+
+// Hash types that can be selected for key and BID generation
+const (
+	HashSHA512     = hashSHA512
+	HashSHA256     = hashSHA256
+	HashBLAKE2b512 = hashBLAKE2b512
 )
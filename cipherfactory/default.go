@@ -1,9 +1,6 @@
 package cipherfactory
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/sha512"
 	"encoding/hex"
 	"errors"
 	"hash"
@@ -17,42 +14,36 @@ var (
 )
 
 type defaultFactory struct {
+	cipherType byte // Cipher suite used for encryption
+	hashType   byte // Hash used for key and BID generation
 }
 
 func (d *defaultFactory) GetMinKeySourceBytes() int {
-	return cipherAES256KeySourceLength
+	if suite := getCipherSuite(d.cipherType); suite != nil {
+		return suite.KeyLength
+	}
+	return 0
 }
 
 func (d *defaultFactory) CreateEncryptor(keySource, ivSource []byte, output io.Writer) (writer io.Writer, key string, err error) {
 
-	// Need at least 32 bytes of the key source
-	if len(keySource) < cipherAES256KeySourceLength {
-		err = ErrInsufficientKeySource
-		return
+	suite := getCipherSuite(d.cipherType)
+	if suite == nil {
+		return nil, "", ErrUnknownKeyType
 	}
 
-	// Create the iv
-	var iv [aes.BlockSize]byte
-	copy(iv[:], ivSource)
-
-	// Create AES-compatible key
-	keyRaw := keySource[:cipherAES256KeySourceLength]
-	key = cipherAES256Hex + hex.EncodeToString(keyRaw)
+	if len(keySource) < suite.KeyLength {
+		return nil, "", ErrInsufficientKeySource
+	}
+	keyRaw := keySource[:suite.KeyLength]
 
-	// Generate the encrypted content
-	blobCipher, err := aes.NewCipher(keyRaw)
+	writer, err = suite.NewEncryptor(keyRaw, suite.iv(ivSource), output)
 	if err != nil {
-		return
+		return nil, "", err
 	}
 
-	// Generate the writer
-	writer = &cipher.StreamWriter{
-		S: cipher.NewCFBEncrypter(
-			blobCipher,
-			iv[:]),
-		W: output}
-
-	return
+	key = hex.EncodeToString([]byte{suite.KeyType}) + hex.EncodeToString(keyRaw)
+	return writer, key, nil
 }
 
 func (d *defaultFactory) CreateDecryptor(key string, ivSource []byte, input io.Reader) (reader io.Reader, err error) {
@@ -61,39 +52,30 @@ func (d *defaultFactory) CreateDecryptor(key string, ivSource []byte, input io.R
 		return nil, ErrInvalidKey
 	}
 
-	switch keyRaw[0] {
-	case cipherAES256:
-		return d.createDecryptorAES256(keyRaw[1:], ivSource, input)
+	suite := getCipherSuite(keyRaw[0])
+	if suite == nil {
+		return nil, ErrUnknownKeyType
 	}
 
-	return nil, ErrUnknownKeyType
-}
-
-func (d *defaultFactory) createDecryptorAES256(key []byte, ivSource []byte, input io.Reader) (reader io.Reader, err error) {
-
-	if len(key) != cipherAES256KeySourceLength {
+	if len(keyRaw)-1 != suite.KeyLength {
 		return nil, ErrInvalidKey
 	}
 
-	// Normalize the iv
-	var iv [aes.BlockSize]byte
-	copy( iv[:], ivSource );
+	return suite.NewDecryptor(keyRaw[1:], suite.iv(ivSource), input)
+}
 
-	// Create new base cipher
-	blobCipher, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
+func (d *defaultFactory) CreateHasher() (hasher hash.Hash, err error) {
+	return d.CreateBIDHasher()
+}
 
-	// Generate the reader in CFB mode
-	return &cipher.StreamReader{
-			S: cipher.NewCFBDecrypter(
-				blobCipher,
-				iv[:]),
-			R: input},
-		nil
+func (d *defaultFactory) CreateBIDHasher() (hasher BIDHasher, err error) {
+	return newBIDHasher(d.hashType)
 }
 
-func (d *defaultFactory) CreateHasher() (hasher hash.Hash, err error) {
-	return sha512.New(), nil
+func (d *defaultFactory) CreateBIDHasherFor(bid string) (hasher BIDHasher, err error) {
+	hashType, err := bidHashType(bid)
+	if err != nil {
+		return nil, err
+	}
+	return newBIDHasher(hashType)
 }
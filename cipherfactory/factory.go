@@ -11,14 +11,15 @@ type Factory interface {
 	// Get minimum number of bytes in the key source
 	GetMinKeySourceBytes() int
 
-	// TODO: Shouldn't we operate on io.WriterCloser here ?
-	// Create io.Writer to encrypt data writter and save to provided writer,
+	// Create io.Writer to encrypt data writter and save to provided writer
 	// Parameters:
 	//   keySource - byte blob used as source for the key computation
 	//   ivSource  - byte blob used as source for the iv computation
 	//   output    - writer used as the output for produced bytes
 	// Returns:
-	//   writer - writer where plain data should be written
+	//   writer - writer where plain data should be written, if it also
+	//            implements io.Closer, it must be closed once all data is
+	//            written to flush any buffered data (see NewEncryptor)
 	//   key    - key in string form that can be used to create decryptor
 	//   err    - error
 	CreateEncryptor(keySource, ivSource []byte, output io.Writer) (writer io.Writer, key string, err error)
@@ -32,7 +33,106 @@ type Factory interface {
 	CreateHasher() (hasher hash.Hash, err error)
 }
 
-// Create default factory
-func Create() Factory {
-	return &defaultFactory{}
+// Optional interface of factories supporting BIDs of different hash types,
+// factories not implementing it generate legacy BIDs with the hasher
+// returned from CreateHasher (see NewBIDHasher)
+type BIDHasherFactory interface {
+
+	// Create hasher for generation of new BIDs, it uses the same hash
+	// algorithm as the one returned from CreateHasher
+	CreateBIDHasher() (hasher BIDHasher, err error)
+
+	// Create hasher that can be used to validate given BID, the hash
+	// algorithm is detected from the BID itself
+	CreateBIDHasherFor(bid string) (hasher BIDHasher, err error)
+}
+
+// Create encryptor using given factory, the returned writer must always
+// be closed once all data is written, closing it does not close the output
+func NewEncryptor(f Factory, keySource, ivSource []byte, output io.Writer) (writer io.WriteCloser, key string, err error) {
+	w, key, err := f.CreateEncryptor(keySource, ivSource, output)
+	if err != nil {
+		return nil, "", err
+	}
+	if writer, ok := w.(io.WriteCloser); ok {
+		return writer, key, nil
+	}
+	return nopCloseWriter{w}, key, nil
+}
+
+// Create hasher for generation of new BIDs using given factory
+func NewBIDHasher(f Factory) (hasher BIDHasher, err error) {
+	if bf, ok := f.(BIDHasherFactory); ok {
+		return bf.CreateBIDHasher()
+	}
+	return newLegacyBIDHasher(f)
+}
+
+// Create hasher validating given BID using given factory, factories
+// without BIDHasherFactory support use their own hasher for BIDs of
+// matching length and built-in hash algorithms for all other BIDs
+func NewBIDHasherFor(f Factory, bid string) (hasher BIDHasher, err error) {
+	if bf, ok := f.(BIDHasherFactory); ok {
+		return bf.CreateBIDHasherFor(bid)
+	}
+	legacy, err := newLegacyBIDHasher(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(bid) == 2*legacy.Size() {
+		return legacy, nil
+	}
+	hashType, err := bidHashType(bid)
+	if err != nil {
+		return nil, err
+	}
+	return newBIDHasher(hashType)
+}
+
+func newLegacyBIDHasher(f Factory) (BIDHasher, error) {
+	h, err := f.CreateHasher()
+	if err != nil {
+		return nil, err
+	}
+	return &bidHasher{Hash: h, hashType: hashSHA512}, nil
+}
+
+// Option changing the behavior of the factory
+type Option func(d *defaultFactory)
+
+// Select the cipher suite used for encryption by its key type,
+// CreateEncryptor fails with ErrUnknownKeyType if such suite
+// is not registered
+func WithCipher(cipherType int) Option {
+	return func(d *defaultFactory) {
+		d.cipherType = byte(cipherType)
+	}
+}
+
+// Select the hash used for key derivation and BID generation,
+// hashers can't be created if such hash is not known
+func WithHash(hashType int) Option {
+	return func(d *defaultFactory) {
+		d.hashType = byte(hashType)
+	}
+}
+
+// Create default factory, it can decrypt data encrypted with any
+// registered cipher suite and validate BIDs of any known hash type,
+// AES-256 and SHA-512 are used unless selected otherwise with options
+func Create(options ...Option) Factory {
+	d := &defaultFactory{cipherType: cipherAES256, hashType: hashSHA512}
+	for _, option := range options {
+		option(d)
+	}
+	return d
+}
+
+// Create default factory using given cipher for encryption, decryption
+// is always possible for all registered ciphers
+func CreateForCipher(cipherType int) (Factory, error) {
+	if cipherType < 0 || cipherType > 0xFF || getCipherSuite(byte(cipherType)) == nil {
+		return nil, ErrUnknownKeyType
+	}
+	return Create(WithCipher(cipherType)), nil
 }
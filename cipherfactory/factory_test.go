@@ -3,7 +3,10 @@ package cipherfactory
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"hash"
 	"io"
+	"io/ioutil"
 	"testing"
 )
 
@@ -160,6 +163,49 @@ func TestFactoryEncryptorDecryptorPair(t *testing.T) {
 	}
 }
 
+func TestFactoryStreamEncryptorDecryptorPair(t *testing.T) {
+
+	f, err := CreateForCipher(CipherAES256GCM)
+	if err != nil {
+		t.Fatalf("Couldn't create factory: %v", err)
+	}
+
+	for _, testData := range [][]byte{
+		[]byte{},
+		[]byte{47},
+		[]byte{54, 55, 56, 57, 58, 59, 60, 61, 62, 63, 64, 65, 66, 67, 68, 69, 70, 71, 72, 73, 74, 75, 76},
+		make([]byte, 1089),
+	} {
+
+		buff := &bytes.Buffer{}
+		key := make([]byte, f.GetMinKeySourceBytes())
+
+		// Data is sealed in chunks, the last one is written when closed
+		enc, keyStr, err := NewEncryptor(f, key, nil, buff)
+		if err != nil {
+			t.Fatalf("Error creating encryptor: %v", err)
+		}
+		if _, err = enc.Write(testData); err != nil {
+			t.Fatalf("Error writing to encryptor: %v", err)
+		}
+		if err = enc.Close(); err != nil {
+			t.Fatalf("Error closing encryptor: %v", err)
+		}
+
+		dec, err := f.CreateDecryptor(keyStr, nil, buff)
+		if err != nil {
+			t.Fatalf("Error creating decryptor: %v", err)
+		}
+		data, err := ioutil.ReadAll(dec)
+		if err != nil {
+			t.Fatalf("Couldn't decode data: %v", err)
+		}
+		if !bytes.Equal(data, testData) {
+			t.Fatal("Decryptor returned invalid data")
+		}
+	}
+}
+
 func TestFactoryFailDecryptor(t *testing.T) {
 
 	f := Create()
@@ -196,3 +242,68 @@ func TestFactoryHasher(t *testing.T) {
 		t.Fatalf("Invalid size of generated hash, at least 16 bytes is required")
 	}
 }
+
+// Factory implementing only the original interface
+type legacyFactory struct {
+	Factory
+}
+
+func (l legacyFactory) CreateEncryptor(keySource, ivSource []byte, output io.Writer) (io.Writer, string, error) {
+	w, key, err := l.Factory.CreateEncryptor(keySource, ivSource, output)
+	if err != nil {
+		return nil, "", err
+	}
+	return w.(nopCloseWriter).Writer, key, nil
+}
+
+func (l legacyFactory) CreateHasher() (hash.Hash, error) {
+	return sha256.New(), nil
+}
+
+func TestLegacyFactory(t *testing.T) {
+
+	f := legacyFactory{Create()}
+	if _, ok := Factory(f).(BIDHasherFactory); ok {
+		t.Fatal("Legacy factory must not support BID hashers")
+	}
+
+	buff := &bytes.Buffer{}
+	enc, keyStr, err := NewEncryptor(f, make([]byte, f.GetMinKeySourceBytes()), nil, buff)
+	if err != nil {
+		t.Fatalf("Error creating encryptor: %v", err)
+	}
+	enc.Write([]byte("hello world"))
+	if err = enc.Close(); err != nil {
+		t.Fatalf("Error closing encryptor: %v", err)
+	}
+	dec, err := f.CreateDecryptor(keyStr, nil, buff)
+	if err != nil {
+		t.Fatalf("Error creating decryptor: %v", err)
+	}
+	if data, _ := ioutil.ReadAll(dec); string(data) != "hello world" {
+		t.Fatal("Invalid data decrypted")
+	}
+
+	// BIDs are generated from the factory's own hasher without any prefix
+	h, err := NewBIDHasher(f)
+	if err != nil {
+		t.Fatalf("Couldn't create hasher: %v", err)
+	}
+	h.Write([]byte("hello world"))
+	legacyBid := h.BID()
+	if legacyBid != bidTestVectors[1].bid[2:] {
+		t.Fatalf("Invalid legacy BID: %v", legacyBid)
+	}
+
+	// BIDs of the factory's hash and of built-in hashes can be validated
+	for _, bid := range []string{legacyBid, bidTestVectors[0].bid, bidTestVectors[2].bid} {
+		h, err = NewBIDHasherFor(f, bid)
+		if err != nil {
+			t.Fatalf("Couldn't create hasher for BID: %v", err)
+		}
+		h.Write([]byte("hello world"))
+		if h.BID() != bid {
+			t.Fatalf("Invalid hasher detected for BID: %v", bid)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package cipherfactory
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"golang.org/x/crypto/blake2b"
+	"hash"
+)
+
+// BIDs are hex-encoded hashes prefixed with the hash type byte. Legacy BIDs
+// of SHA-512 hashes don't carry any prefix and are recognized by their
+// length, SHA-512 BIDs are still generated in this form for compatibility.
+
+var (
+	ErrUnknownHashType = errors.New("Unknown hash type")
+	ErrInvalidBID      = errors.New("Invalid BID")
+)
+
+// Hasher used to generate BIDs
+type BIDHasher interface {
+	hash.Hash
+
+	// Get the BID of data written so far
+	BID() string
+}
+
+type hashAlgorithm struct {
+	create func() hash.Hash
+	size   int
+}
+
+var hashAlgorithms = map[byte]hashAlgorithm{
+	hashSHA512:     {sha512.New, sha512.Size},
+	hashSHA256:     {sha256.New, sha256.Size},
+	hashBLAKE2b512: {newBLAKE2b512, blake2b.Size},
+}
+
+func newBLAKE2b512() hash.Hash {
+	h, _ := blake2b.New512(nil)
+	return h
+}
+
+type bidHasher struct {
+	hash.Hash
+	hashType byte
+}
+
+func (h *bidHasher) BID() string {
+	sum := hex.EncodeToString(h.Sum(nil))
+	if h.hashType == hashSHA512 {
+		return sum
+	}
+	return hex.EncodeToString([]byte{h.hashType}) + sum
+}
+
+func newBIDHasher(hashType byte) (BIDHasher, error) {
+	algorithm, ok := hashAlgorithms[hashType]
+	if !ok {
+		return nil, ErrUnknownHashType
+	}
+	return &bidHasher{Hash: algorithm.create(), hashType: hashType}, nil
+}
+
+// Find out the hash type used to generate given BID
+func bidHashType(bid string) (byte, error) {
+	if len(bid) == 2*sha512.Size {
+		return hashSHA512, nil
+	}
+	raw, err := hex.DecodeString(bid)
+	if err != nil || len(raw) < 1 {
+		return 0, ErrInvalidBID
+	}
+	algorithm, ok := hashAlgorithms[raw[0]]
+	if !ok || raw[0] == hashSHA512 {
+		return 0, ErrUnknownHashType
+	}
+	if len(raw)-1 != algorithm.size {
+		return 0, ErrInvalidBID
+	}
+	return raw[0], nil
+}
@@ -0,0 +1,70 @@
+package cipherfactory
+
+import (
+	"strings"
+	"testing"
+)
+
+var bidTestVectors = []struct {
+	hashType int
+	bid      string
+}{
+	{HashSHA512, "" +
+		"309ecc489c12d6eb4cc40f50c902f2b4d0ed77ee511a7c7a9bcd3ca86d4cd86f" +
+		"989dd35bc5ff499670da34255b45b0cfd830e81f605dcf7dc5542e93ae9cd76f"},
+	{HashSHA256, "02" +
+		"b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"},
+	{HashBLAKE2b512, "03" +
+		"021ced8799296ceca557832ab941a50b4a11f83478cf141f51f933f653ab9fbc" +
+		"c05a037cddbed06e309bf334942c4e58cdf1a46e237911ccd7fcf9787cbc7fd0"},
+}
+
+func TestBIDHashers(t *testing.T) {
+
+	for _, tv := range bidTestVectors {
+
+		f := Create(WithHash(tv.hashType))
+
+		h, err := NewBIDHasher(f)
+		if err != nil {
+			t.Fatalf("Couldn't create hasher: %v", err)
+		}
+		h.Write([]byte("hello world"))
+		if bid := h.BID(); bid != tv.bid {
+			t.Fatalf("Invalid BID for hash type %v: %v", tv.hashType, bid)
+		}
+
+		// Any factory must detect the hash type from the BID
+		h, err = NewBIDHasherFor(Create(), tv.bid)
+		if err != nil {
+			t.Fatalf("Couldn't create hasher for BID: %v", err)
+		}
+		h.Write([]byte("hello world"))
+		if h.BID() != tv.bid {
+			t.Fatalf("Invalid hasher detected for hash type %v", tv.hashType)
+		}
+	}
+}
+
+func TestInvalidBIDs(t *testing.T) {
+
+	for _, test := range []struct {
+		bid string
+		err error
+	}{
+		{"", ErrInvalidBID},
+		{"zz", ErrInvalidBID},
+		{"02abcd", ErrInvalidBID},
+		{"03" + strings.Repeat("00", 65), ErrInvalidBID},
+		{"ff" + strings.Repeat("00", 32), ErrUnknownHashType},
+		{"01" + strings.Repeat("00", 64), ErrUnknownHashType},
+	} {
+		if _, err := NewBIDHasherFor(Create(), test.bid); err != test.err {
+			t.Errorf("Invalid error for BID %v, expected: %v, got: %v", test.bid, test.err, err)
+		}
+	}
+
+	if _, err := Create(WithHash(0xFF)).CreateHasher(); err != ErrUnknownHashType {
+		t.Fatalf("Invalid error for unknown hash type: %v", err)
+	}
+}
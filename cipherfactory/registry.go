@@ -0,0 +1,71 @@
+package cipherfactory
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	ErrInvalidCipherSuite    = errors.New("Invalid cipher suite")
+	ErrCipherSuiteRegistered = errors.New("Cipher suite with such key type is already registered")
+)
+
+// Description of a cipher that can be used by the factory
+type CipherSuite struct {
+
+	// Key type, the first byte of the key identifying the cipher
+	KeyType byte
+
+	// Length of the raw key in bytes, the same number of bytes
+	// is required from the key source
+	KeyLength int
+
+	// Derive the iv from the iv source, the iv source is passed
+	// unchanged to constructors if nil
+	DeriveIV func(ivSource []byte) []byte
+
+	// Create the encrypting writer, closing it must flush all data
+	// without closing the output
+	NewEncryptor func(key, iv []byte, output io.Writer) (io.WriteCloser, error)
+
+	// Create the decrypting reader
+	NewDecryptor func(key, iv []byte, input io.Reader) (io.Reader, error)
+}
+
+func (s *CipherSuite) iv(ivSource []byte) []byte {
+	if s.DeriveIV == nil {
+		return ivSource
+	}
+	return s.DeriveIV(ivSource)
+}
+
+var (
+	cipherSuites     = make(map[byte]*CipherSuite)
+	cipherSuitesLock sync.RWMutex
+)
+
+// Register new cipher suite, once registered, all factories will be able
+// to decrypt data with keys of the suite's type
+func RegisterCipherSuite(suite CipherSuite) error {
+
+	if suite.KeyLength <= 0 || suite.NewEncryptor == nil || suite.NewDecryptor == nil {
+		return ErrInvalidCipherSuite
+	}
+
+	cipherSuitesLock.Lock()
+	defer cipherSuitesLock.Unlock()
+
+	if _, exists := cipherSuites[suite.KeyType]; exists {
+		return ErrCipherSuiteRegistered
+	}
+	cipherSuites[suite.KeyType] = &suite
+	return nil
+}
+
+// Find the cipher suite for given key type, nil is returned if not found
+func getCipherSuite(keyType byte) *CipherSuite {
+	cipherSuitesLock.RLock()
+	defer cipherSuitesLock.RUnlock()
+	return cipherSuites[keyType]
+}
@@ -0,0 +1,105 @@
+package cipherfactory
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// Trivial (and insecure) cipher used to test the registry
+type xorStream struct {
+	key []byte
+	pos int
+}
+
+func (x *xorStream) XORKeyStream(dst, src []byte) {
+	for i, b := range src {
+		dst[i] = b ^ x.key[x.pos%len(x.key)]
+		x.pos++
+	}
+}
+
+var testSuite = CipherSuite{
+	KeyType:   0xF0,
+	KeyLength: 4,
+	NewEncryptor: func(key, iv []byte, output io.Writer) (io.WriteCloser, error) {
+		return nopCloseWriter{&xorWriter{&xorStream{key: key}, output}}, nil
+	},
+	NewDecryptor: func(key, iv []byte, input io.Reader) (io.Reader, error) {
+		return &xorReader{&xorStream{key: key}, input}, nil
+	},
+}
+
+type xorWriter struct {
+	s *xorStream
+	w io.Writer
+}
+
+func (x *xorWriter) Write(p []byte) (int, error) {
+	b := make([]byte, len(p))
+	x.s.XORKeyStream(b, p)
+	return x.w.Write(b)
+}
+
+type xorReader struct {
+	s *xorStream
+	r io.Reader
+}
+
+func (x *xorReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	x.s.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+func TestCipherSuiteRegistry(t *testing.T) {
+
+	// Not yet registered
+	if _, err := CreateForCipher(int(testSuite.KeyType)); err != ErrUnknownKeyType {
+		t.Fatalf("Invalid error for unknown cipher: %v", err)
+	}
+	_, _, err := Create(WithCipher(int(testSuite.KeyType))).CreateEncryptor(make([]byte, 32), nil, &bytes.Buffer{})
+	if err != ErrUnknownKeyType {
+		t.Fatalf("Invalid error for unknown cipher: %v", err)
+	}
+
+	if err := RegisterCipherSuite(testSuite); err != nil {
+		t.Fatalf("Couldn't register cipher suite: %v", err)
+	}
+	if err := RegisterCipherSuite(testSuite); err != ErrCipherSuiteRegistered {
+		t.Fatalf("Invalid error for duplicated cipher suite: %v", err)
+	}
+	if err := RegisterCipherSuite(CipherSuite{KeyType: 0xF1}); err != ErrInvalidCipherSuite {
+		t.Fatalf("Invalid error for incomplete cipher suite: %v", err)
+	}
+
+	f := Create(WithCipher(int(testSuite.KeyType)))
+	if f.GetMinKeySourceBytes() != testSuite.KeyLength {
+		t.Fatalf("Invalid key length: %v", f.GetMinKeySourceBytes())
+	}
+
+	data := []byte("Hello World!")
+	keyStr, encrypted := encryptTestData(t, f, data, nil)
+	if keyStr[:2] != "f0" {
+		t.Fatalf("Invalid key type: %v", keyStr[:2])
+	}
+
+	// Default factory must be able to decrypt all registered ciphers
+	dec, err := Create().CreateDecryptor(keyStr, nil, bytes.NewReader(encrypted))
+	if err != nil {
+		t.Fatalf("Error creating decryptor: %v", err)
+	}
+	decrypted, err := ioutil.ReadAll(dec)
+	if err != nil {
+		t.Fatalf("Couldn't decrypt data: %v", err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Fatal("Decryptor returned invalid data")
+	}
+
+	// Invalid key length
+	if _, err = Create().CreateDecryptor(keyStr+"00", nil, bytes.NewReader(encrypted)); err != ErrInvalidKey {
+		t.Fatalf("Invalid error for incorrect key length: %v", err)
+	}
+}
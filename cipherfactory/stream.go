@@ -0,0 +1,188 @@
+package cipherfactory
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+// Chunked AEAD encryption (STREAM construction). Data is split into chunks
+// of streamChunkSize bytes, each one sealed separately with a nonce built
+// from the iv prefix, the chunk counter and the last chunk flag. This way
+// chunks can't be reordered, duplicated or truncated without detection.
+// The nonce has room for a few bytes of the iv only, thus each stream is
+// encrypted with its own subkey derived from the key and the whole iv.
+
+const (
+	streamChunkSize    = 64 * 1024
+	streamCounterBytes = 4
+	streamMaxChunks    = 1<<32 - 1
+)
+
+var (
+	ErrAuthenticationFailed = errors.New("Message authentication failed")
+	ErrStreamTooLong        = errors.New("Stream exceeds the maximum number of chunks")
+	ErrStreamClosed         = errors.New("Stream has already been closed")
+)
+
+// Derive the key of a single stream with HKDF-SHA256 using the iv as salt
+func streamSubkey(key, iv []byte) ([]byte, error) {
+	subkey := make([]byte, len(key))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, iv, []byte("cinode stream")), subkey); err != nil {
+		return nil, err
+	}
+	return subkey, nil
+}
+
+// Build the nonce for given chunk
+func streamNonce(aead cipher.AEAD, prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	prefixLen := len(nonce) - streamCounterBytes - 1
+	copy(nonce[:prefixLen], prefix)
+	binary.BigEndian.PutUint32(nonce[prefixLen:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type streamEncryptor struct {
+	aead    cipher.AEAD
+	prefix  []byte
+	output  io.Writer
+	buffer  []byte
+	counter uint32
+	closed  bool
+}
+
+func newStreamEncryptor(aead cipher.AEAD, ivSource []byte, output io.Writer) *streamEncryptor {
+	prefix := make([]byte, aead.NonceSize()-streamCounterBytes-1)
+	copy(prefix, ivSource)
+	return &streamEncryptor{
+		aead:   aead,
+		prefix: prefix,
+		output: output,
+		buffer: make([]byte, 0, streamChunkSize),
+	}
+}
+
+func (s *streamEncryptor) sealChunk(last bool) error {
+	if s.counter == streamMaxChunks {
+		return ErrStreamTooLong
+	}
+	nonce := streamNonce(s.aead, s.prefix, s.counter, last)
+	sealed := s.aead.Seal(nil, nonce, s.buffer, nil)
+	s.counter++
+	s.buffer = s.buffer[:0]
+	_, err := s.output.Write(sealed)
+	return err
+}
+
+func (s *streamEncryptor) Write(p []byte) (n int, err error) {
+	if s.closed {
+		return 0, ErrStreamClosed
+	}
+	for len(p) > 0 {
+
+		// Full chunk is sealed only once we know it's not the last one
+		if len(s.buffer) == streamChunkSize {
+			if err = s.sealChunk(false); err != nil {
+				return
+			}
+		}
+
+		c := copy(s.buffer[len(s.buffer):streamChunkSize], p)
+		s.buffer = s.buffer[:len(s.buffer)+c]
+		p = p[c:]
+		n += c
+	}
+	return
+}
+
+// Seal the last chunk, the output writer is not closed
+func (s *streamEncryptor) Close() error {
+	if s.closed {
+		return ErrStreamClosed
+	}
+	s.closed = true
+	return s.sealChunk(true)
+}
+
+type streamDecryptor struct {
+	aead    cipher.AEAD
+	prefix  []byte
+	input   io.Reader
+	carry   []byte // Data read ahead from the next chunk
+	plain   []byte // Decrypted data not yet returned
+	counter uint32
+	done    bool
+	err     error
+}
+
+func newStreamDecryptor(aead cipher.AEAD, ivSource []byte, input io.Reader) *streamDecryptor {
+	prefix := make([]byte, aead.NonceSize()-streamCounterBytes-1)
+	copy(prefix, ivSource)
+	return &streamDecryptor{
+		aead:   aead,
+		prefix: prefix,
+		input:  input,
+	}
+}
+
+func (s *streamDecryptor) openChunk() error {
+
+	// Read one byte more than the sealed chunk size
+	// to find out whether this is the last chunk
+	sealedSize := streamChunkSize + s.aead.Overhead()
+	buff := make([]byte, sealedSize+1)
+	copy(buff, s.carry)
+	n, err := io.ReadFull(s.input, buff[len(s.carry):])
+	n += len(s.carry)
+
+	last := false
+	switch err {
+	case nil:
+		s.carry = buff[sealedSize:]
+		buff = buff[:sealedSize]
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+		s.carry = nil
+		buff = buff[:n]
+	default:
+		return err
+	}
+
+	if s.counter == streamMaxChunks {
+		return ErrStreamTooLong
+	}
+	nonce := streamNonce(s.aead, s.prefix, s.counter, last)
+	plain, err := s.aead.Open(buff[:0], nonce, buff, nil)
+	if err != nil {
+		return ErrAuthenticationFailed
+	}
+
+	s.counter++
+	s.plain = plain
+	s.done = last
+	return nil
+}
+
+func (s *streamDecryptor) Read(p []byte) (n int, err error) {
+	for len(s.plain) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+		if s.err = s.openChunk(); s.err != nil {
+			return 0, s.err
+		}
+	}
+	n = copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
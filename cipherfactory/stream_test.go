@@ -0,0 +1,165 @@
+package cipherfactory
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+func encryptTestData(t *testing.T, f Factory, data, iv []byte) (string, []byte) {
+
+	key := make([]byte, f.GetMinKeySourceBytes())
+	rand.Read(key)
+
+	buff := &bytes.Buffer{}
+	enc, keyStr, err := NewEncryptor(f, key, iv, buff)
+	if err != nil {
+		t.Fatalf("Error creating encryptor: %v", err)
+	}
+	if _, err = enc.Write(data); err != nil {
+		t.Fatalf("Error writing to encryptor: %v", err)
+	}
+	if err = enc.Close(); err != nil {
+		t.Fatalf("Error closing encryptor: %v", err)
+	}
+	return keyStr, buff.Bytes()
+}
+
+func testAuthenticatedCipher(t *testing.T, cipherType int, keyPrefix string) {
+
+	f, err := CreateForCipher(cipherType)
+	if err != nil {
+		t.Fatalf("Couldn't create factory: %v", err)
+	}
+
+	iv := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	for _, size := range []int{0, 1, 17, streamChunkSize - 1, streamChunkSize, streamChunkSize + 1, 3*streamChunkSize + 5} {
+
+		data := make([]byte, size)
+		rand.Read(data)
+
+		keyStr, encrypted := encryptTestData(t, f, data, iv)
+		if keyStr[:2] != keyPrefix {
+			t.Fatalf("Invalid key type: %v", keyStr[:2])
+		}
+
+		// Decryption must work with any factory
+		dec, err := Create().CreateDecryptor(keyStr, iv, bytes.NewReader(encrypted))
+		if err != nil {
+			t.Fatalf("Error creating decryptor: %v", err)
+		}
+		decrypted, err := ioutil.ReadAll(dec)
+		if err != nil {
+			t.Fatalf("Couldn't decrypt data of size %v: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, data) {
+			t.Fatalf("Decryptor returned invalid data for size %v", size)
+		}
+
+		// Any modification must be detected
+		for _, tampered := range [][]byte{
+			encrypted[:len(encrypted)-1],
+			append(append([]byte{}, encrypted...), 0),
+			encrypted[:len(encrypted)/2],
+			func() []byte {
+				b := append([]byte{}, encrypted...)
+				b[len(b)/2] ^= 0x01
+				return b
+			}(),
+		} {
+			dec, err := f.CreateDecryptor(keyStr, iv, bytes.NewReader(tampered))
+			if err != nil {
+				t.Fatalf("Error creating decryptor: %v", err)
+			}
+			if _, err = ioutil.ReadAll(dec); err != ErrAuthenticationFailed {
+				t.Fatalf("Modified ciphertext not detected for size %v: %v", size, err)
+			}
+		}
+
+		// Invalid iv must be detected
+		dec, _ = f.CreateDecryptor(keyStr, []byte{9}, bytes.NewReader(encrypted))
+		if _, err = ioutil.ReadAll(dec); err != ErrAuthenticationFailed {
+			t.Fatalf("Invalid iv not detected: %v", err)
+		}
+	}
+}
+
+func TestAES256GCM(t *testing.T) {
+	testAuthenticatedCipher(t, CipherAES256GCM, cipherAES256GCMHex)
+}
+
+func TestStreamLongIV(t *testing.T) {
+
+	for _, cipherType := range []int{CipherAES256GCM} {
+
+		f, _ := CreateForCipher(cipherType)
+		key := make([]byte, f.GetMinKeySourceBytes())
+		data := []byte("AAAAAAAAAAAA")
+
+		// Ivs differ only in bytes that don't fit into the nonce prefix
+		iv1, iv2 := make([]byte, 24), make([]byte, 24)
+		iv2[23] = 1
+
+		encrypt := func(iv []byte) (string, []byte) {
+			buff := &bytes.Buffer{}
+			enc, keyStr, err := NewEncryptor(f, key, iv, buff)
+			if err != nil {
+				t.Fatalf("Error creating encryptor: %v", err)
+			}
+			enc.Write(data)
+			enc.Close()
+			return keyStr, buff.Bytes()
+		}
+		keyStr, encrypted1 := encrypt(iv1)
+		_, encrypted2 := encrypt(iv2)
+		if bytes.Equal(encrypted1[:len(data)], encrypted2[:len(data)]) {
+			t.Fatalf("Keystream reused for different ivs of cipher %v", cipherType)
+		}
+
+		dec, _ := f.CreateDecryptor(keyStr, iv2, bytes.NewReader(encrypted1))
+		if _, err := ioutil.ReadAll(dec); err != ErrAuthenticationFailed {
+			t.Fatalf("Data decrypted with invalid iv for cipher %v: %v", cipherType, err)
+		}
+	}
+}
+
+func TestLegacyKeyWithGCMFactory(t *testing.T) {
+
+	data := []byte("Hello World!")
+	keyStr, encrypted := encryptTestData(t, Create(), data, nil)
+
+	f, _ := CreateForCipher(CipherAES256GCM)
+	dec, err := f.CreateDecryptor(keyStr, nil, bytes.NewReader(encrypted))
+	if err != nil {
+		t.Fatalf("Error creating decryptor: %v", err)
+	}
+	decrypted, err := ioutil.ReadAll(dec)
+	if err != nil {
+		t.Fatalf("Couldn't decrypt data: %v", err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Fatal("Decryptor returned invalid data")
+	}
+}
+
+func TestUnknownCipher(t *testing.T) {
+	if _, err := CreateForCipher(0xFF); err != ErrUnknownKeyType {
+		t.Fatalf("Invalid error for unknown cipher: %v", err)
+	}
+}
+
+func TestStreamClosed(t *testing.T) {
+
+	f, _ := CreateForCipher(CipherAES256GCM)
+	enc, _, _ := NewEncryptor(f, make([]byte, f.GetMinKeySourceBytes()), nil, &bytes.Buffer{})
+	enc.Close()
+
+	if _, err := enc.Write([]byte{1}); err != ErrStreamClosed {
+		t.Fatalf("Invalid error when writing to closed stream: %v", err)
+	}
+	if err := enc.Close(); err != ErrStreamClosed {
+		t.Fatalf("Invalid error when closing stream twice: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package cipherfactory
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+)
+
+// Built-in cipher suites
+func init() {
+	for _, suite := range []CipherSuite{
+		{
+			KeyType:      cipherAES256,
+			KeyLength:    cipherAES256KeySourceLength,
+			DeriveIV:     deriveBlockIV,
+			NewEncryptor: newAES256CFBEncryptor,
+			NewDecryptor: newAES256CFBDecryptor,
+		},
+		{
+			KeyType:      cipherAES256GCM,
+			KeyLength:    cipherAES256GCMKeySourceLength,
+			NewEncryptor: streamEncryptorFor(newAES256GCM),
+			NewDecryptor: streamDecryptorFor(newAES256GCM),
+		},
+	} {
+		if err := RegisterCipherSuite(suite); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Normalize the iv to the AES block size
+func deriveBlockIV(ivSource []byte) []byte {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, ivSource)
+	return iv
+}
+
+// Writer that does not close the underlying writer
+type nopCloseWriter struct {
+	io.Writer
+}
+
+func (nopCloseWriter) Close() error {
+	return nil
+}
+
+func newAES256CFBEncryptor(key, iv []byte, output io.Writer) (io.WriteCloser, error) {
+	blobCipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return nopCloseWriter{&cipher.StreamWriter{
+			S: cipher.NewCFBEncrypter(blobCipher, iv),
+			W: output}},
+		nil
+}
+
+func newAES256CFBDecryptor(key, iv []byte, input io.Reader) (io.Reader, error) {
+	blobCipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &cipher.StreamReader{
+			S: cipher.NewCFBDecrypter(blobCipher, iv),
+			R: input},
+		nil
+}
+
+func newAES256GCM(key []byte) (cipher.AEAD, error) {
+	blockCipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blockCipher)
+}
+
+// Create AEAD cipher keyed with the subkey of the stream
+func newStreamAEAD(newAEAD func(key []byte) (cipher.AEAD, error), key, iv []byte) (cipher.AEAD, error) {
+	subkey, err := streamSubkey(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(subkey)
+}
+
+// Create the encryptor constructor for chunked AEAD cipher
+func streamEncryptorFor(newAEAD func(key []byte) (cipher.AEAD, error)) func(key, iv []byte, output io.Writer) (io.WriteCloser, error) {
+	return func(key, iv []byte, output io.Writer) (io.WriteCloser, error) {
+		aead, err := newStreamAEAD(newAEAD, key, iv)
+		if err != nil {
+			return nil, err
+		}
+		return newStreamEncryptor(aead, iv, output), nil
+	}
+}
+
+// Create the decryptor constructor for chunked AEAD cipher
+func streamDecryptorFor(newAEAD func(key []byte) (cipher.AEAD, error)) func(key, iv []byte, input io.Reader) (io.Reader, error) {
+	return func(key, iv []byte, input io.Reader) (io.Reader, error) {
+		aead, err := newStreamAEAD(newAEAD, key, iv)
+		if err != nil {
+			return nil, err
+		}
+		return newStreamDecryptor(aead, iv, input), nil
+	}
+}
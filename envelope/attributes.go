@@ -0,0 +1,212 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envelope
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Standard attributes, supported by every envelope type where meaningful.
+// Values are nil if the attribute is not available, i.e. if there's no
+// content stored yet.
+const (
+	AttrType        = "type"        // Envelope type (int)
+	AttrChunks      = "chunks"      // Number of chunks (int)
+	AttrSize        = "size"        // Total size of content of all chunks (int64)
+	AttrContentType = "contentType" // MIME type detected from the content of the first chunk (string)
+	AttrCreated     = "created"     // Creation time of the current content (time.Time)
+)
+
+// Type-specific attributes, names are prefixed with the namespace of the
+// envelope type. Names without the namespace are accepted as well.
+const (
+	AttrSignedVersion   = "signed.version"   // uint64
+	AttrSignedPublicKey = "signed.publicKey" // ed25519.PublicKey
+	AttrSignedRevoked   = "signed.revoked"   // bool
+
+	AttrLogPublicKey = "log.publicKey" // ed25519.PublicKey
+
+	AttrExpiringExpires = "expiring.expires" // time.Time
+
+	AttrMultiSigVersion    = "multisig.version"    // uint64
+	AttrMultiSigThreshold  = "multisig.threshold"  // int
+	AttrMultiSigPublicKeys = "multisig.publicKeys" // All signers ([]ed25519.PublicKey)
+	AttrMultiSigSigners    = "multisig.signers"    // Signers of the stored content ([]ed25519.PublicKey)
+)
+
+// Number of bytes used to detect the content type
+const contentTypeSniffLength = 512
+
+// Get the name of type-specific attribute without the namespace
+func typeAttribute(namespace, name string) string {
+	return strings.TrimPrefix(name, namespace+".")
+}
+
+// Get the value of standard attribute, ok is false if the name is not one
+// of standard attributes. Creation time is not known here, types storing it
+// must handle it before.
+func standardAttribute(e Envelope, name string) (value interface{}, ok bool) {
+
+	switch name {
+	case AttrType:
+		return e.GetType(), true
+
+	case AttrChunks:
+		return e.GetChunksCount(), true
+
+	case AttrSize:
+		chunks := e.GetChunksCount()
+		if chunks == 0 {
+			return nil, true
+		}
+		var size int64
+		for i := 0; i < chunks; i++ {
+			n, err := readChunkData(e, i, ioutil.Discard, -1)
+			if err != nil {
+				return nil, true
+			}
+			size += n
+		}
+		return size, true
+
+	case AttrContentType:
+		if e.GetChunksCount() == 0 {
+			return nil, true
+		}
+		var b bytes.Buffer
+		if _, err := readChunkData(e, 0, &b, contentTypeSniffLength); err != nil {
+			return nil, true
+		}
+		return http.DetectContentType(b.Bytes()), true
+
+	case AttrCreated:
+		return nil, true
+	}
+
+	return nil, false
+}
+
+// Copy the content of the chunk, at most limit bytes are copied if limit
+// is not negative
+func readChunkData(e Envelope, chunkNumber int, w io.Writer, limit int64) (int64, error) {
+
+	r, err := e.GetChunkReader(chunkNumber)
+	if err != nil {
+		return 0, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	if limit >= 0 {
+		r = io.LimitReader(r, limit)
+	}
+	return io.Copy(w, r)
+}
+
+// Typed access to envelope attributes, the ok value is false
+// if the attribute is not available
+type Attributes struct {
+	e Envelope
+}
+
+// Get typed accessor for attributes of given envelope
+func GetAttributes(e Envelope) Attributes {
+	return Attributes{e: e}
+}
+
+// Get envelope type
+func (a Attributes) Type() int {
+	return a.e.GetType()
+}
+
+// Get number of chunks
+func (a Attributes) Chunks() int {
+	return a.e.GetChunksCount()
+}
+
+// Get the total size of the content
+func (a Attributes) Size() (size int64, ok bool) {
+	size, ok = a.e.GetAttribute(AttrSize).(int64)
+	return
+}
+
+// Get the MIME type of the content
+func (a Attributes) ContentType() (contentType string, ok bool) {
+	contentType, ok = a.e.GetAttribute(AttrContentType).(string)
+	return
+}
+
+// Get the creation time of the current content
+func (a Attributes) Created() (created time.Time, ok bool) {
+	created, ok = a.e.GetAttribute(AttrCreated).(time.Time)
+	return
+}
+
+// Get the version of signed or multi-signature envelope
+func (a Attributes) Version() (version uint64, ok bool) {
+	switch a.e.GetType() {
+	case TypeSigned:
+		version, ok = a.e.GetAttribute(AttrSignedVersion).(uint64)
+	case TypeMultiSig:
+		version, ok = a.e.GetAttribute(AttrMultiSigVersion).(uint64)
+	}
+	return
+}
+
+// Get the public key of the owner of signed or log envelope
+func (a Attributes) PublicKey() (pubKey ed25519.PublicKey, ok bool) {
+	switch a.e.GetType() {
+	case TypeSigned:
+		pubKey, ok = a.e.GetAttribute(AttrSignedPublicKey).(ed25519.PublicKey)
+	case TypeLog:
+		pubKey, ok = a.e.GetAttribute(AttrLogPublicKey).(ed25519.PublicKey)
+	}
+	return
+}
+
+// Check whether the signed envelope has been revoked
+func (a Attributes) Revoked() bool {
+	revoked, _ := a.e.GetAttribute(AttrSignedRevoked).(bool)
+	return revoked && a.e.GetType() == TypeSigned
+}
+
+// Get the expiration time of expiring envelope
+func (a Attributes) Expires() (expires time.Time, ok bool) {
+	if a.e.GetType() == TypeExpiring {
+		expires, ok = a.e.GetAttribute(AttrExpiringExpires).(time.Time)
+	}
+	return
+}
+
+// Get the threshold of multi-signature envelope
+func (a Attributes) Threshold() (threshold int, ok bool) {
+	if a.e.GetType() == TypeMultiSig {
+		threshold, ok = a.e.GetAttribute(AttrMultiSigThreshold).(int)
+	}
+	return
+}
+
+// Get keys of all signers of multi-signature envelope
+func (a Attributes) PublicKeys() (pubKeys []ed25519.PublicKey, ok bool) {
+	if a.e.GetType() == TypeMultiSig {
+		pubKeys, ok = a.e.GetAttribute(AttrMultiSigPublicKeys).([]ed25519.PublicKey)
+	}
+	return
+}
+
+// Get keys of signers of the content stored in multi-signature envelope
+func (a Attributes) Signers() (signers []ed25519.PublicKey, ok bool) {
+	if a.e.GetType() == TypeMultiSig {
+		signers, ok = a.e.GetAttribute(AttrMultiSigSigners).([]ed25519.PublicKey)
+	}
+	return
+}
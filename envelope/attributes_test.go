@@ -0,0 +1,169 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envelope
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/cinode/golib/localstorage"
+	"testing"
+	"time"
+)
+
+func TestStandardAttributes(t *testing.T) {
+	s := localstorage.InMemory()
+
+	e, err := New(TypeHash, s, nil)
+	noError(err, t)
+	if v := e.GetAttribute(AttrSize); v != nil {
+		t.Fatalf("Unexpected size of empty envelope: %v", v)
+	}
+	if v := e.GetAttribute(AttrChunks); v != 0 {
+		t.Fatalf("Invalid number of chunks: %v", v)
+	}
+	writeChunk(e, []byte("Hello World!"), t)
+
+	if v := e.GetAttribute(AttrType); v != TypeHash {
+		t.Fatalf("Invalid type: %v", v)
+	}
+	if v := e.GetAttribute(AttrChunks); v != 1 {
+		t.Fatalf("Invalid number of chunks: %v", v)
+	}
+	if v := e.GetAttribute(AttrSize); v != int64(12) {
+		t.Fatalf("Invalid size: %v", v)
+	}
+	if v := e.GetAttribute(AttrContentType); v != "text/plain; charset=utf-8" {
+		t.Fatalf("Invalid content type: %v", v)
+	}
+	if v := e.GetAttribute(AttrCreated); v != nil {
+		t.Fatalf("Unexpected creation time of hash envelope: %v", v)
+	}
+	if v := e.GetAttribute("unknown"); v != nil {
+		t.Fatalf("Unexpected value of unknown attribute: %v", v)
+	}
+
+	a := GetAttributes(e)
+	if size, ok := a.Size(); !ok || size != 12 {
+		t.Fatalf("Invalid size: %v", size)
+	}
+	if _, ok := a.Version(); ok {
+		t.Fatal("Hash envelope has no version")
+	}
+	if _, ok := a.Created(); ok {
+		t.Fatal("Hash envelope has no creation time")
+	}
+
+	// Binary content of log spread across chunks
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	noError(err, t)
+	l, err := NewLog(privKey, s, nil)
+	noError(err, t)
+	writeChunk(l, []byte{0, 1, 2}, t)
+	writeChunk(l, []byte{3, 4}, t)
+
+	a = GetAttributes(l)
+	if size, ok := a.Size(); !ok || size != 5 {
+		t.Fatalf("Invalid size: %v", size)
+	}
+	if ct, ok := a.ContentType(); !ok || ct != "application/octet-stream" {
+		t.Fatalf("Invalid content type: %v", ct)
+	}
+	if pubKey, ok := a.PublicKey(); !ok || !pubKey.Equal(privKey.Public()) {
+		t.Fatal("Invalid public key")
+	}
+	if l.GetAttribute(AttrLogPublicKey) == nil {
+		t.Fatal("Namespaced attribute not found")
+	}
+}
+
+func TestSignedAttributes(t *testing.T) {
+	s := localstorage.InMemory()
+
+	created := time.Unix(1400000000, 0)
+	defer setNow(created)()
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	noError(err, t)
+	e, err := NewSigned(privKey, s, nil)
+	noError(err, t)
+	writeChunk(e, []byte("<html><body>Hello</body></html>"), t)
+
+	a := GetAttributes(e)
+	if c, ok := a.Created(); !ok || !c.Equal(created) {
+		t.Fatalf("Invalid creation time: %v", c)
+	}
+	if ct, ok := a.ContentType(); !ok || ct != "text/html; charset=utf-8" {
+		t.Fatalf("Invalid content type: %v", ct)
+	}
+	if v, ok := a.Version(); !ok || v != 1 {
+		t.Fatalf("Invalid version: %v", v)
+	}
+	if e.GetAttribute(AttrSignedVersion) != e.GetAttribute("version") {
+		t.Fatal("Namespaced and plain attribute names must give the same value")
+	}
+	if a.Revoked() {
+		t.Fatal("Envelope is not revoked")
+	}
+
+	// New version updates the creation time
+	defer setNow(created.Add(time.Hour))()
+	noError(e.Revoke(), t)
+	if c, ok := a.Created(); !ok || !c.Equal(created.Add(time.Hour)) {
+		t.Fatalf("Invalid creation time: %v", c)
+	}
+	if !a.Revoked() {
+		t.Fatal("Envelope is revoked")
+	}
+	if _, ok := a.Size(); ok {
+		t.Fatal("Size of revoked content must not be available")
+	}
+	if _, ok := a.Expires(); ok {
+		t.Fatal("Signed envelope has no expiration time")
+	}
+}
+
+func TestMultiSigAndExpiringAttributes(t *testing.T) {
+	s := localstorage.InMemory()
+	pubKeys, privKeys := generateSigners(3, t)
+
+	e, err := NewMultiSig(2, pubKeys, s, nil)
+	noError(err, t)
+	noError(e.AddSigningKey(privKeys[1]), t)
+	noError(e.AddSigningKey(privKeys[2]), t)
+	writeChunk(e, []byte("release"), t)
+
+	a := GetAttributes(e)
+	if th, ok := a.Threshold(); !ok || th != 2 {
+		t.Fatalf("Invalid threshold: %v", th)
+	}
+	if keys, ok := a.PublicKeys(); !ok || len(keys) != 3 {
+		t.Fatalf("Invalid public keys: %v", keys)
+	}
+	if signers, ok := a.Signers(); !ok || len(signers) != 2 || !signers[0].Equal(pubKeys[1]) {
+		t.Fatalf("Invalid signers: %v", signers)
+	}
+	if v, ok := a.Version(); !ok || v != 1 {
+		t.Fatalf("Invalid version: %v", v)
+	}
+	if _, ok := a.Created(); ok {
+		t.Fatal("Multi-signature envelope has no creation time")
+	}
+
+	expires := time.Unix(1400000000, 0)
+	defer setNow(expires.Add(-time.Hour))()
+	x, err := NewExpiring(expires, s, nil)
+	noError(err, t)
+	writeChunk(x, []byte("temporary"), t)
+
+	if exp, ok := GetAttributes(x).Expires(); !ok || !exp.Equal(expires) {
+		t.Fatalf("Invalid expiration time: %v", exp)
+	}
+	if exp, ok := x.GetAttribute(AttrExpiringExpires).(time.Time); !ok || !exp.Equal(expires) {
+		t.Fatalf("Invalid expiration time: %v", exp)
+	}
+	if size, ok := GetAttributes(x).Size(); !ok || size != 9 {
+		t.Fatalf("Invalid size: %v", size)
+	}
+}
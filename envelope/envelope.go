@@ -1,6 +1,7 @@
 package envelope
 
 import (
+	"context"
 	"io"
 )
 
@@ -21,6 +22,10 @@ type Envelope interface {
 	// validation result will be returned on failure
 	Validate() error
 
+	// Same as Validate but can be cancelled through the context, progress
+	// function (if not nil) is called with the number of bytes read so far
+	ValidateContext(ctx context.Context, progress func(n int64)) error
+
 	// Get the BID for this envelope, this can be empty string in case
 	// the blob has not been fully created yet (i.e. it may require
 	// at least one chunk to be written)
@@ -29,7 +34,9 @@ type Envelope interface {
 	// Get number of blob chunks contained within that envelope
 	GetChunksCount() int
 
-	// Get chunk reader
+	// Get chunk reader, the underlying blob is released once the content
+	// is read to the end. The reader is also an io.Closer, close it when
+	// the content is not read to the end.
 	GetChunkReader(chunkNumber int) (reader io.Reader, err error)
 
 	// Get writer to new chunk that will be appended to list of chunks
@@ -42,7 +49,10 @@ type Envelope interface {
 	// blob generation
 	GetNewChunkWriter() (writer io.WriteCloser, err error)
 
-	// Get named attribute, null will be returned for invalid name
+	// Get named attribute, null will be returned for invalid name.
+	// Standard attributes (AttrType, AttrSize etc.) are supported by all
+	// envelope types, type-specific ones are prefixed with the namespace
+	// of the type. Use GetAttributes for typed access.
 	GetAttribute(name string) interface{}
 
 	// Synchronize current blob with other node.
@@ -53,3 +63,33 @@ type Envelope interface {
 	// perform various attacks on our node.
 	SynchronizeWithOtherNode(channel io.ReadWriteCloser, active bool) error
 }
+
+// Reader of the chunk content, the blob reader is closed once the end
+// of the content is reached or when closed explicitly
+type chunkReader struct {
+	r      io.Reader
+	closer io.Closer
+}
+
+func newChunkReader(r io.Reader, closer io.Closer) *chunkReader {
+	return &chunkReader{r: r, closer: closer}
+}
+
+func (c *chunkReader) Read(p []byte) (n int, err error) {
+	if c.r == nil {
+		return 0, io.EOF
+	}
+	n, err = c.r.Read(p)
+	if err != nil {
+		c.Close()
+	}
+	return
+}
+
+func (c *chunkReader) Close() error {
+	if c.r == nil {
+		return nil
+	}
+	c.r = nil
+	return c.closer.Close()
+}
@@ -0,0 +1,337 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envelope
+
+import (
+	"context"
+	"github.com/cinode/golib/cipherfactory"
+	"github.com/cinode/golib/localstorage"
+	"github.com/cinode/golib/utils"
+	"io"
+	"time"
+)
+
+// Source of the current time, replaced in tests
+var now = time.Now
+
+func init() {
+	RegisterType(TypeExpiring, newEnvelopeExpiring)
+}
+
+// Create expiring envelope, it's a hash envelope with the expiration time
+// covered by the BID. Expired envelopes are no longer valid and can be
+// removed with ReapExpired.
+func NewExpiring(expires time.Time, storage localstorage.Storage, cf cipherfactory.Factory) (Envelope, error) {
+	if expires.Unix() <= 0 {
+		return nil, ErrInvalidExpirationTime
+	}
+	return &envelopeExpiring{
+		storage: storage,
+		cf:      getCipherFactory(cf),
+		expires: expires.Unix(),
+	}, nil
+}
+
+func newEnvelopeExpiring(bid string, storage localstorage.Storage, cf cipherfactory.Factory) Envelope {
+	return &envelopeExpiring{bid: bid, storage: storage, cf: getCipherFactory(cf)}
+}
+
+type envelopeExpiring struct {
+	bid     string
+	storage localstorage.Storage
+	cf      cipherfactory.Factory
+	expires int64 // Expiration time of the new envelope
+	writing bool  // Flag indicating that the chunk writer has been created
+}
+
+// Read the expiration time, returned reader is positioned at the content
+func (e *envelopeExpiring) readHeader() (expires int64, r localstorage.Reader, err error) {
+
+	r, err = e.storage.GetBlobReader(e.bid)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	t, err := utils.DeserializeInt(r)
+	if err == nil && t != TypeExpiring {
+		err = ErrInvalidEnvelopeType
+	}
+	var v uint64
+	if err == nil {
+		v, err = utils.DeserializeInt(r)
+	}
+	if err != nil {
+		r.Close()
+		return 0, nil, err
+	}
+
+	return int64(v), r, nil
+}
+
+// Get envelope type
+func (e *envelopeExpiring) GetType() int {
+	return TypeExpiring
+}
+
+// Make sure the envelope is valid by analyzing the content in the
+// assigned storage, null will be returned on success, error with
+// validation result will be returned on failure. Expired envelopes
+// are not valid.
+func (e *envelopeExpiring) Validate() error {
+	return e.ValidateContext(context.Background(), nil)
+}
+
+// Validate the envelope, the expiration time is checked once the content
+// is hashed
+func (e *envelopeExpiring) ValidateContext(ctx context.Context, progress func(n int64)) error {
+	v := *e
+	v.storage = newValidationStorage(ctx, e.storage, progress)
+	return v.validate()
+}
+
+func (e *envelopeExpiring) validate() error {
+
+	expires, r, err := e.readHeader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Hash algorithm is taken from the BID
+	hasher, err := cipherfactory.NewBIDHasherFor(e.cf, e.bid)
+	if err != nil {
+		return err
+	}
+
+	// BID is the hash of the expiration time and the content
+	utils.SerializeInt(uint64(expires), hasher)
+	if _, err = io.Copy(hasher, r); err != nil {
+		return err
+	}
+	if hasher.BID() != e.bid {
+		return ErrInvalidHashBID
+	}
+
+	if !now().Before(time.Unix(expires, 0)) {
+		return ErrExpired
+	}
+
+	return nil
+}
+
+// Get the BID for this envelope, this can be empty string in case
+// the content has not been written yet
+func (e *envelopeExpiring) GetBID() string {
+	return e.bid
+}
+
+// Get number of blob chunks contained within that envelope
+func (e *envelopeExpiring) GetChunksCount() int {
+	if e.bid == "" {
+		return 0
+	}
+	return 1
+}
+
+// Get chunk reader
+func (e *envelopeExpiring) GetChunkReader(chunkNumber int) (reader io.Reader, err error) {
+
+	if chunkNumber < 0 || chunkNumber >= e.GetChunksCount() {
+		return nil, ErrInvalidChunkNumber
+	}
+
+	_, r, err := e.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	return newChunkReader(r, r), nil
+}
+
+// Get writer to new chunk, expiring envelope does contain exactly
+// one chunk, the BID is known once the writer is closed. Content larger
+// than what can be synchronized is refused with ErrChunkTooLarge.
+func (e *envelopeExpiring) GetNewChunkWriter() (writer io.WriteCloser, err error) {
+
+	if e.bid != "" || e.writing {
+		return nil, ErrTooManyChunks
+	}
+
+	hasher, err := cipherfactory.NewBIDHasher(e.cf)
+	if err != nil {
+		return nil, err
+	}
+	utils.SerializeInt(uint64(e.expires), hasher)
+
+	w, err := e.storage.GetBlobWriter()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = utils.SerializeInt(TypeExpiring, w); err == nil {
+		err = utils.SerializeInt(uint64(e.expires), w)
+	}
+	if err != nil {
+		w.Rollback()
+		return nil, err
+	}
+
+	e.writing = true
+	return &envelopeExpiringWriter{e: e, w: w, hasher: hasher}, nil
+}
+
+// Writer of the expiring envelope content
+type envelopeExpiringWriter struct {
+	e      *envelopeExpiring
+	w      localstorage.Writer
+	hasher cipherfactory.BIDHasher
+	size   int64
+	err    error // Error that makes the content invalid, blob is not stored
+}
+
+func (w *envelopeExpiringWriter) Write(p []byte) (n int, err error) {
+	if w.e == nil {
+		return 0, ErrWriterClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.size+int64(len(p)) > maxEnvelopeContentSize {
+		w.err = ErrChunkTooLarge
+		return 0, w.err
+	}
+	n, err = w.w.Write(p)
+	w.hasher.Write(p[:n])
+	w.size += int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return
+}
+
+// Commit the blob under the hash of the expiration time and the content
+func (w *envelopeExpiringWriter) Close() error {
+	if w.e == nil {
+		return ErrWriterClosed
+	}
+	e := w.e
+	w.e = nil
+
+	if w.err != nil {
+		w.w.Rollback()
+		e.writing = false
+		return w.err
+	}
+
+	bid := w.hasher.BID()
+	if err := w.w.Commit(bid); err != nil {
+		e.writing = false
+		return err
+	}
+
+	e.bid = bid
+	return nil
+}
+
+// Get named attribute, null will be returned for invalid name.
+// Standard attributes are supported together with "expiring.expires"
+// (time.Time).
+func (e *envelopeExpiring) GetAttribute(name string) interface{} {
+
+	if value, ok := standardAttribute(e, name); ok {
+		return value
+	}
+
+	if typeAttribute("expiring", name) != "expires" {
+		return nil
+	}
+	if e.bid == "" {
+		return time.Unix(e.expires, 0)
+	}
+
+	expires, r, err := e.readHeader()
+	if err != nil {
+		return nil
+	}
+	r.Close()
+	return time.Unix(expires, 0)
+}
+
+// Synchronize current blob with other node.
+//
+// The communicatino channel should be established between two
+// envelopes of exactly the same type. This method should be very
+// carefull though since the communication channel may be used to
+// perform various attacks on our node.
+func (e *envelopeExpiring) SynchronizeWithOtherNode(channel io.ReadWriteCloser, active bool) error {
+	return synchronize(e, channel, active)
+}
+
+// Expiring envelope has data or not
+func (e *envelopeExpiring) syncSummary() (uint64, error) {
+	r, err := e.storage.GetBlobReader(e.bid)
+	if err == localstorage.ErrNoSuchBlob {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	r.Close()
+	return 1, nil
+}
+
+func (e *envelopeExpiring) writeSyncData(w io.Writer, peerSummary uint64) error {
+	return writeSyncBlob(w, e.storage, e.bid)
+}
+
+// Expired envelopes are not accepted since they don't validate
+func (e *envelopeExpiring) readSyncData(r io.Reader, peerSummary uint64) error {
+	return readSyncBlob(r, e.storage, e.bid, func(tmp localstorage.Storage) error {
+		return newEnvelopeExpiring(e.bid, tmp, e.cf).Validate()
+	})
+}
+
+// Remove expired envelopes from the storage. Only expiring envelopes
+// failing validation with ErrExpired are removed, envelopes of other types,
+// invalid envelopes and blobs that are not envelopes are left untouched.
+// Returns ids of removed blobs, on error those removed so far are returned.
+// The storage must implement localstorage.Lister and localstorage.Deleter,
+// localstorage.ErrNotSupported is returned otherwise.
+func ReapExpired(storage localstorage.Storage, cf cipherfactory.Factory) (removed []string, err error) {
+
+	lister, ok := storage.(localstorage.Lister)
+	if !ok {
+		return nil, localstorage.ErrNotSupported
+	}
+	deleter, ok := storage.(localstorage.Deleter)
+	if !ok {
+		return nil, localstorage.ErrNotSupported
+	}
+
+	blobIds, err := lister.ListBlobs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bid := range blobIds {
+
+		e, err := Open(bid, storage, cf)
+		if err != nil || e.GetType() != TypeExpiring {
+			continue
+		}
+
+		// Expiration time is covered by the BID thus it can't be
+		// trusted before the whole envelope is validated
+		if e.Validate() != ErrExpired {
+			continue
+		}
+
+		if err = deleter.DeleteBlob(bid); err != nil && err != localstorage.ErrNoSuchBlob {
+			return removed, err
+		}
+		removed = append(removed, bid)
+	}
+
+	return removed, nil
+}
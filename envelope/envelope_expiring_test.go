@@ -0,0 +1,160 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envelope
+
+import (
+	"bytes"
+	"errors"
+	"github.com/cinode/golib/localstorage"
+	"github.com/cinode/golib/utils"
+	"testing"
+	"time"
+)
+
+// Set the current time for the duration of the test
+func setNow(t time.Time) func() {
+	saved := now
+	now = func() time.Time { return t }
+	return func() { now = saved }
+}
+
+func TestExpiring(t *testing.T) {
+	s := localstorage.InMemory()
+
+	start := time.Unix(1400000000, 0)
+	defer setNow(start)()
+
+	_, err := NewExpiring(time.Time{}, s, nil)
+	needError(err, ErrInvalidExpirationTime, t)
+
+	expires := start.Add(time.Hour)
+	e, err := NewExpiring(expires, s, nil)
+	noError(err, t)
+	if tp := e.GetType(); tp != TypeExpiring {
+		t.Fatalf("Expected type: %v, got: %v", TypeExpiring, tp)
+	}
+	writeChunk(e, []byte("hello world"), t)
+	noError(e.Validate(), t)
+
+	_, err = e.GetNewChunkWriter()
+	needError(err, ErrTooManyChunks, t)
+
+	e2, err := Open(e.GetBID(), s, nil)
+	noError(err, t)
+	noError(e2.Validate(), t)
+	if exp, ok := e2.GetAttribute("expires").(time.Time); !ok || !exp.Equal(expires) {
+		t.Fatalf("Invalid expiration time: %v", e2.GetAttribute("expires"))
+	}
+	if data := readChunk(e2, 0, t); !bytes.Equal(data, []byte("hello world")) {
+		t.Fatalf("Invalid chunk content: %q", data)
+	}
+
+	// Same content with other expiration time gets other BID
+	e3, err := NewExpiring(expires.Add(time.Second), s, nil)
+	noError(err, t)
+	writeChunk(e3, []byte("hello world"), t)
+	if e3.GetBID() == e.GetBID() {
+		t.Fatal("Expiration time must be covered by the BID")
+	}
+
+	// Extending the lifetime is detected
+	modifyBlob(s, e.GetBID(), func(data []byte) []byte {
+		var b bytes.Buffer
+		utils.SerializeInt(TypeExpiring, &b)
+		utils.SerializeInt(uint64(expires.Add(time.Hour).Unix()), &b)
+		b.WriteString("hello world")
+		return b.Bytes()
+	}, t)
+	needError(e.Validate(), ErrInvalidHashBID, t)
+
+	defer setNow(expires)()
+	noError(e3.Validate(), t)
+	defer setNow(expires.Add(time.Second))()
+	needError(e3.Validate(), ErrExpired, t)
+}
+
+// Storage failing to remove blobs
+type noDeleteStorage struct {
+	localstorage.Storage
+}
+
+func (s noDeleteStorage) ListBlobs() ([]string, error) {
+	return s.Storage.(localstorage.Lister).ListBlobs()
+}
+
+func (noDeleteStorage) DeleteBlob(blobId string) error {
+	return errors.New("Can't delete")
+}
+
+// Storage hiding optional interfaces
+type basicStorage struct {
+	localstorage.Storage
+}
+
+func TestReapExpired(t *testing.T) {
+	s := localstorage.InMemory()
+
+	start := time.Unix(1400000000, 0)
+	defer setNow(start)()
+
+	expired, err := NewExpiring(start.Add(time.Minute), s, nil)
+	noError(err, t)
+	writeChunk(expired, []byte("expired"), t)
+
+	alive, err := NewExpiring(start.Add(time.Hour), s, nil)
+	noError(err, t)
+	writeChunk(alive, []byte("alive"), t)
+
+	permanent, err := New(TypeHash, s, nil)
+	noError(err, t)
+	writeChunk(permanent, []byte("permanent"), t)
+
+	// Expired envelope with tampered content is not valid thus it's kept
+	tampered, err := NewExpiring(start.Add(time.Minute), s, nil)
+	noError(err, t)
+	writeChunk(tampered, []byte("tampered"), t)
+	modifyBlob(s, tampered.GetBID(), func(data []byte) []byte {
+		return append(data, '!')
+	}, t)
+
+	w, err := s.GetBlobWriter()
+	noError(err, t)
+	w.Write([]byte{0x7F})
+	noError(w.Commit("not an envelope"), t)
+
+	defer setNow(start.Add(time.Minute - time.Second))()
+	removed, err := ReapExpired(s, nil)
+	noError(err, t)
+	if len(removed) != 0 {
+		t.Fatalf("Nothing should be removed yet: %v", removed)
+	}
+
+	// Envelope is expired once the expiration time is reached
+	defer setNow(start.Add(time.Minute))()
+	needError(expired.Validate(), ErrExpired, t)
+
+	_, err = ReapExpired(basicStorage{s}, nil)
+	needError(err, localstorage.ErrNotSupported, t)
+
+	removed, err = ReapExpired(noDeleteStorage{s}, nil)
+	anyError(err, t)
+	if len(removed) != 0 {
+		t.Fatalf("Blobs reported as removed: %v", removed)
+	}
+
+	removed, err = ReapExpired(s, nil)
+	noError(err, t)
+	if len(removed) != 1 || removed[0] != expired.GetBID() {
+		t.Fatalf("Invalid list of removed blobs: %v", removed)
+	}
+
+	blobIds, err := s.(localstorage.Lister).ListBlobs()
+	noError(err, t)
+	if len(blobIds) != 4 {
+		t.Fatalf("Invalid number of blobs left: %v", len(blobIds))
+	}
+	noError(alive.Validate(), t)
+	noError(permanent.Validate(), t)
+}
@@ -1,17 +1,26 @@
 package envelope
 
 import (
-	"encoding/hex"
+	"context"
 	"github.com/cinode/golib/cipherfactory"
 	"github.com/cinode/golib/localstorage"
 	"github.com/cinode/golib/utils"
 	"io"
 )
 
+func init() {
+	RegisterType(TypeHash, newEnvelopeHash)
+}
+
+func newEnvelopeHash(bid string, storage localstorage.Storage, cf cipherfactory.Factory) Envelope {
+	return &envelopeHash{bid: bid, storage: storage, cf: getCipherFactory(cf)}
+}
+
 type envelopeHash struct {
 	bid     string
 	storage localstorage.Storage
 	cf      cipherfactory.Factory
+	writing bool // Flag indicating that the chunk writer has been created
 }
 
 // Get envelope type
@@ -23,6 +32,17 @@ func (e *envelopeHash) GetType() int {
 // assigned storage, null will be returned on success, error with
 // validation result will be returned on failure
 func (e *envelopeHash) Validate() error {
+	return e.ValidateContext(context.Background(), nil)
+}
+
+// Validate the envelope, the content is hashed while being read
+func (e *envelopeHash) ValidateContext(ctx context.Context, progress func(n int64)) error {
+	v := *e
+	v.storage = newValidationStorage(ctx, e.storage, progress)
+	return v.validate()
+}
+
+func (e *envelopeHash) validate() error {
 
 	r, err := e.storage.GetBlobReader(e.bid)
 	if err != nil {
@@ -39,7 +59,8 @@ func (e *envelopeHash) Validate() error {
 		return ErrInvalidEnvelopeType
 	}
 
-	hasher, err := e.cf.CreateHasher()
+	// Hash algorithm is taken from the BID
+	hasher, err := cipherfactory.NewBIDHasherFor(e.cf, e.bid)
 	if err != nil {
 		return err
 	}
@@ -50,7 +71,7 @@ func (e *envelopeHash) Validate() error {
 	}
 
 	// BID must be equal to hash of the content
-	if hex.EncodeToString(hasher.Sum(nil)) != e.bid {
+	if hasher.BID() != e.bid {
 		return ErrInvalidHashBID
 	}
 
@@ -84,7 +105,23 @@ func (e *envelopeHash) GetChunkReader(chunkNumber int) (reader io.Reader, err er
 		return nil, ErrInvalidChunkNumber
 	}
 
-	panic("Unimplemented")
+	r, err := e.storage.GetBlobReader(e.bid)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := utils.DeserializeInt(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	if t != TypeHash {
+		r.Close()
+		return nil, ErrInvalidEnvelopeType
+	}
+
+	// The rest of the blob is the content
+	return newChunkReader(r, r), nil
 }
 
 // Get writer to new chunk that will be appended to list of chunks
@@ -95,13 +132,96 @@ func (e *envelopeHash) GetChunkReader(chunkNumber int) (reader io.Reader, err er
 // Make sure to close the writer after writing all data. Closing the
 // writer does actually materialize the chunk and in some cases finalize
 // blob generation
+//
+// Hash envelope does contain exactly one chunk, the BID is known
+// once the writer is closed. The content must fit into the limit of data
+// exchanged during synchronization (32 MiB minus headers), writing more
+// fails with ErrChunkTooLarge and nothing is stored.
 func (e *envelopeHash) GetNewChunkWriter() (writer io.WriteCloser, err error) {
-	panic("Unimplemented")
+
+	if e.bid != "" || e.writing {
+		return nil, ErrTooManyChunks
+	}
+
+	hasher, err := cipherfactory.NewBIDHasher(e.cf)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := e.storage.GetBlobWriter()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = utils.SerializeInt(TypeHash, w); err != nil {
+		w.Rollback()
+		return nil, err
+	}
+
+	e.writing = true
+	return &envelopeHashWriter{e: e, w: w, hasher: hasher}, nil
 }
 
-// Get named attribute, null will be returned for invalid name
+// Writer of the hash envelope content
+type envelopeHashWriter struct {
+	e      *envelopeHash
+	w      localstorage.Writer
+	hasher cipherfactory.BIDHasher
+	size   int64
+	err    error // Error that makes the content invalid, blob is not stored
+}
+
+func (w *envelopeHashWriter) Write(p []byte) (n int, err error) {
+	if w.e == nil {
+		return 0, ErrWriterClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.size+int64(len(p)) > maxEnvelopeContentSize {
+		w.err = ErrChunkTooLarge
+		return 0, w.err
+	}
+	n, err = w.w.Write(p)
+	w.hasher.Write(p[:n])
+	w.size += int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return
+}
+
+// Commit the blob under the hash of the content
+func (w *envelopeHashWriter) Close() error {
+	if w.e == nil {
+		return ErrWriterClosed
+	}
+	e := w.e
+	w.e = nil
+
+	if w.err != nil {
+		w.w.Rollback()
+		e.writing = false
+		return w.err
+	}
+
+	bid := w.hasher.BID()
+	if err := w.w.Commit(bid); err != nil {
+		w.w.Rollback()
+		e.writing = false
+		return err
+	}
+
+	e.bid = bid
+	return nil
+}
+
+// Get named attribute, null will be returned for invalid name. Only
+// standard attributes are supported, the creation time is not known
+// since it would change the BID of the same content.
 func (e *envelopeHash) GetAttribute(name string) interface{} {
-	panic("Unimplemented")
+	value, _ := standardAttribute(e, name)
+	return value
 }
 
 // Synchronize current blob with other node.
@@ -111,5 +231,28 @@ func (e *envelopeHash) GetAttribute(name string) interface{} {
 // carefull though since the communication channel may be used to
 // perform various attacks on our node.
 func (e *envelopeHash) SynchronizeWithOtherNode(channel io.ReadWriteCloser, active bool) error {
-	panic("Unimplemented")
+	return synchronize(e, channel, active)
+}
+
+// Hash envelope has data or not
+func (e *envelopeHash) syncSummary() (uint64, error) {
+	r, err := e.storage.GetBlobReader(e.bid)
+	if err == localstorage.ErrNoSuchBlob {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	r.Close()
+	return 1, nil
+}
+
+func (e *envelopeHash) writeSyncData(w io.Writer, peerSummary uint64) error {
+	return writeSyncBlob(w, e.storage, e.bid)
+}
+
+func (e *envelopeHash) readSyncData(r io.Reader, peerSummary uint64) error {
+	return readSyncBlob(r, e.storage, e.bid, func(tmp localstorage.Storage) error {
+		return newEnvelopeHash(e.bid, tmp, e.cf).Validate()
+	})
 }
@@ -1,8 +1,11 @@
 package envelope
 
 import (
+	"bytes"
 	"github.com/cinode/golib/cipherfactory"
 	"github.com/cinode/golib/localstorage"
+	"io"
+	"io/ioutil"
 	"testing"
 )
 
@@ -20,10 +23,10 @@ func anyError(err error, t *testing.T) {
 
 func needError(err error, errRequired error, t *testing.T) {
 	if err == nil {
-		t.Fatal("Expected error not found, should be: %v", errRequired)
+		t.Fatalf("Expected error not found, should be: %v", errRequired)
 	}
 	if err != errRequired {
-		t.Fatal("Invalid error received, expected: %v, got: %v", errRequired, err)
+		t.Fatalf("Invalid error received, expected: %v, got: %v", errRequired, err)
 	}
 }
 
@@ -73,6 +76,10 @@ var testVector = []struct {
 		bid:  "82aeef202165cf11930ea44a9ad8337aea355d63751a7260552e3e014ad6313bca69c83fa4e3555531d44a1025708183784af0e2002562b7260559ce0e7af262",
 		blob: []byte{0x01, 0x85, 0x5e, 0x29, 0x6f, 0x95, 0xd1, 0xea, 0xf3, 0xfe, 0xb7, 0xd4, 0x8c, 0xe0},
 	},
+	{ // SHA-256 BID
+		bid:  "02b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		blob: []byte("\x01hello world"),
+	},
 }
 
 func TestHashValidation(t *testing.T) {
@@ -99,3 +106,153 @@ func TestHashValidation(t *testing.T) {
 		noError(err, t)
 	}
 }
+
+func TestHashWriteReadCycle(t *testing.T) {
+	s := localstorage.InMemory()
+	cf := cipherfactory.Create()
+
+	e := &envelopeHash{storage: s, cf: cf}
+
+	w, err := e.GetNewChunkWriter()
+	noError(err, t)
+
+	// Only one chunk can be written
+	_, err = e.GetNewChunkWriter()
+	needError(err, ErrTooManyChunks, t)
+
+	_, err = w.Write([]byte("hello world"))
+	noError(err, t)
+
+	if bid := e.GetBID(); bid != "" {
+		t.Fatalf("BID must not be known before closing the writer, got: %v", bid)
+	}
+
+	noError(w.Close(), t)
+	needError(w.Close(), ErrWriterClosed, t)
+	_, err = w.Write([]byte("more"))
+	needError(err, ErrWriterClosed, t)
+
+	// BID is the SHA-512 hash of the content
+	if bid := e.GetBID(); bid != "309ecc489c12d6eb4cc40f50c902f2b4d0ed77ee511a7c7a9bcd3ca86d4cd86f989dd35bc5ff499670da34255b45b0cfd830e81f605dcf7dc5542e93ae9cd76f" {
+		t.Fatalf("Invalid BID: %v", bid)
+	}
+	if cnt := e.GetChunksCount(); cnt != 1 {
+		t.Fatalf("Expected 1 chunk, got %v", cnt)
+	}
+
+	_, err = e.GetNewChunkWriter()
+	needError(err, ErrTooManyChunks, t)
+
+	noError(e.Validate(), t)
+
+	r, err := e.GetChunkReader(0)
+	noError(err, t)
+	data, err := ioutil.ReadAll(r)
+	noError(err, t)
+	if !bytes.Equal(data, []byte("hello world")) {
+		t.Fatalf("Invalid chunk content: %q", data)
+	}
+
+	_, err = e.GetChunkReader(1)
+	needError(err, ErrInvalidChunkNumber, t)
+
+	// SHA-256 based envelope does match the test vector
+	e = &envelopeHash{storage: s, cf: cipherfactory.Create(cipherfactory.WithHash(cipherfactory.HashSHA256))}
+	w, err = e.GetNewChunkWriter()
+	noError(err, t)
+	w.Write([]byte("hello world"))
+	noError(w.Close(), t)
+	if bid := e.GetBID(); bid != testVector[3].bid {
+		t.Fatalf("Invalid BID: %v", bid)
+	}
+}
+
+// Storage tracking blob readers and failing to commit blobs if requested
+type trackingStorage struct {
+	localstorage.Storage
+	open       int
+	failCommit bool
+	rollbacks  int
+}
+
+type trackingReader struct {
+	localstorage.Reader
+	s *trackingStorage
+}
+
+type trackingWriter struct {
+	localstorage.Writer
+	s *trackingStorage
+}
+
+func (s *trackingStorage) GetBlobReader(blobID string) (localstorage.Reader, error) {
+	r, err := s.Storage.GetBlobReader(blobID)
+	if err != nil {
+		return nil, err
+	}
+	s.open++
+	return &trackingReader{Reader: r, s: s}, nil
+}
+
+func (s *trackingStorage) GetBlobWriter() (localstorage.Writer, error) {
+	w, err := s.Storage.GetBlobWriter()
+	if err != nil {
+		return nil, err
+	}
+	return &trackingWriter{Writer: w, s: s}, nil
+}
+
+func (r *trackingReader) Close() error {
+	r.s.open--
+	return r.Reader.Close()
+}
+
+func (w *trackingWriter) Commit(blobID string) error {
+	if w.s.failCommit {
+		return localstorage.ErrInvalidBlobID
+	}
+	return w.Writer.Commit(blobID)
+}
+
+func (w *trackingWriter) Rollback() error {
+	w.s.rollbacks++
+	return w.Writer.Rollback()
+}
+
+func TestHashReaderWriterCleanup(t *testing.T) {
+	s := &trackingStorage{Storage: localstorage.InMemory()}
+
+	// Failed commit rolls the blob back
+	s.failCommit = true
+	e := newEnvelopeHash("", s, nil)
+	w, err := e.GetNewChunkWriter()
+	noError(err, t)
+	w.Write([]byte("hello world"))
+	needError(w.Close(), localstorage.ErrInvalidBlobID, t)
+	if s.rollbacks != 1 {
+		t.Fatalf("Blob not rolled back, rollbacks: %v", s.rollbacks)
+	}
+	if bid := e.GetBID(); bid != "" {
+		t.Fatalf("BID set although the blob was not stored: %v", bid)
+	}
+
+	s.failCommit = false
+	writeChunk(e, []byte("hello world"), t)
+
+	// Blob is released once the content is read to the end
+	if data := readChunk(e, 0, t); !bytes.Equal(data, []byte("hello world")) {
+		t.Fatalf("Invalid chunk content: %q", data)
+	}
+	if s.open != 0 {
+		t.Fatalf("Blob readers left open: %v", s.open)
+	}
+
+	// Or when the reader is closed explicitly
+	r, err := e.GetChunkReader(0)
+	noError(err, t)
+	noError(r.(io.Closer).Close(), t)
+	noError(r.(io.Closer).Close(), t)
+	if s.open != 0 {
+		t.Fatalf("Blob readers left open: %v", s.open)
+	}
+}
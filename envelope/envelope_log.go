@@ -0,0 +1,562 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"github.com/cinode/golib/cipherfactory"
+	"github.com/cinode/golib/localstorage"
+	"github.com/cinode/golib/utils"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	maxLogChunkSize = 1024 * 1024
+	maxLogChunks    = 64 * 1024
+)
+
+func init() {
+	RegisterType(TypeLog, newEnvelopeLog)
+}
+
+// Create append-only log envelope owned by given key, the BID is known
+// right away.
+//
+// Each chunk of the log is signed by the owner and links to the hash of
+// the previous chunk, new chunks are always appended at the end. The whole
+// log must fit into the synchronization limit, appending more data fails
+// with ErrLogTooLarge.
+func NewLog(signingKey ed25519.PrivateKey, storage localstorage.Storage, cf cipherfactory.Factory) (Envelope, error) {
+
+	cf = getCipherFactory(cf)
+
+	bid, err := ownerBID(signingKey, cf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &envelopeLog{
+		bid:        bid,
+		storage:    storage,
+		cf:         cf,
+		signingKey: signingKey,
+	}, nil
+}
+
+func newEnvelopeLog(bid string, storage localstorage.Storage, cf cipherfactory.Factory) Envelope {
+	return &envelopeLog{bid: bid, storage: storage, cf: getCipherFactory(cf)}
+}
+
+type envelopeLog struct {
+	bid        string
+	storage    localstorage.Storage
+	cf         cipherfactory.Factory
+	signingKey ed25519.PrivateKey // Key used to sign new chunks, nil if read-only
+
+	// Maximum size of serialized chunks, maxEnvelopeContentSize if zero
+	sizeLimit int64
+
+	// Chunks verified so far, the log can only grow thus
+	// those don't have to be verified again
+	pubKey    ed25519.PublicKey // Owner key, nil if nothing has been read yet
+	verified  []logChunkInfo
+	chain     logChainValidator // State of the chain after the last verified chunk
+	dataStart int64             // Offset of the first chunk in the blob
+	end       int64             // Offset of the end of the last verified chunk
+}
+
+// Location of verified chunk in the blob
+type logChunkInfo struct {
+	start  int64 // Offset of the serialized chunk
+	offset int64 // Offset of the content
+	size   int64 // Size of the content
+}
+
+// Single chunk of the log
+type logChunk struct {
+	prevHash  []byte // Hash of the previous chunk, empty for the first one
+	signature []byte
+	content   []byte
+}
+
+// Calculate the hash of the chunk, it's also the digest being signed
+func (c *logChunk) hash(index uint64) []byte {
+	hasher := sha512.New()
+	utils.SerializeInt(TypeLog, hasher)
+	utils.SerializeInt(index, hasher)
+	utils.SerializeBuffer(c.prevHash, hasher, sha512.Size)
+	hasher.Write(c.content)
+	return hasher.Sum(nil)
+}
+
+// Serialize the chunk as stored in the blob
+func (c *logChunk) write(w io.Writer) {
+	utils.SerializeBuffer(c.prevHash, w, sha512.Size)
+	utils.SerializeBuffer(c.signature, w, maxSignatureLength)
+	utils.SerializeBuffer(c.content, w, maxLogChunkSize)
+}
+
+// Read serialized chunk, io.EOF is returned at the end of the log
+func readLogChunk(r io.Reader) (c *logChunk, err error) {
+	c = &logChunk{}
+	if c.prevHash, err = utils.DeserializeBuffer(r, sha512.Size); err != nil {
+		return nil, err
+	}
+	if c.signature, err = utils.DeserializeBuffer(r, maxSignatureLength); err != nil {
+		return nil, err
+	}
+	if c.content, err = utils.DeserializeBuffer(r, maxLogChunkSize); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Read the type and the public key of the owner from the beginning of the log
+func (e *envelopeLog) readLogHeader(r io.Reader) (ed25519.PublicKey, error) {
+
+	t, err := utils.DeserializeInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if t != TypeLog {
+		return nil, ErrInvalidEnvelopeType
+	}
+
+	return readOwnerKey(r, e.bid, e.cf)
+}
+
+// Read the public key and pass chunks of the log one by one to given
+// function, nil key is returned if the blob does not exist yet
+func (e *envelopeLog) walkLog(fn func(pubKey ed25519.PublicKey, c *logChunk) error) (pubKey ed25519.PublicKey, err error) {
+
+	r, err := e.storage.GetBlobReader(e.bid)
+	if err == localstorage.ErrNoSuchBlob {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if pubKey, err = e.readLogHeader(r); err != nil {
+		return nil, err
+	}
+
+	for {
+		c, err := readLogChunk(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if err = fn(pubKey, c); err != nil {
+			return nil, err
+		}
+	}
+
+	return pubKey, nil
+}
+
+// Reader counting the number of bytes read
+type logOffsetReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *logOffsetReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	r.n += int64(n)
+	return
+}
+
+// Move the blob reader to given offset, readers that can't seek skip the data
+func skipLogData(r io.Reader, offset int64) error {
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(offset, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(ioutil.Discard, r, offset)
+	return err
+}
+
+// Verify chunks appended since the last refresh and remember their
+// location, verified chunks are not read again
+func (e *envelopeLog) refresh() error {
+
+	r, err := e.storage.GetBlobReader(e.bid)
+	if err == localstorage.ErrNoSuchBlob {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	or := &logOffsetReader{r: r}
+	if e.pubKey == nil {
+		pubKey, err := e.readLogHeader(or)
+		if err != nil {
+			return err
+		}
+		e.pubKey = pubKey
+		e.chain = logChainValidator{pubKey: pubKey}
+		e.dataStart, e.end = or.n, or.n
+	} else {
+		if err = skipLogData(r, e.end); err != nil {
+			return err
+		}
+		or.n = e.end
+	}
+
+	for {
+		start := or.n
+		c, err := readLogChunk(or)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		chain := e.chain
+		if err = chain.check(c); err != nil {
+			return err
+		}
+		e.chain = chain
+
+		size := int64(len(c.content))
+		e.verified = append(e.verified, logChunkInfo{start: start, offset: or.n - size, size: size})
+		e.end = or.n
+	}
+}
+
+// Check whether the log with given number of chunks and total size of
+// serialized chunks fits into the limits
+func (e *envelopeLog) fits(count int, size int64) bool {
+	limit := e.sizeLimit
+	if limit == 0 {
+		limit = maxEnvelopeContentSize
+	}
+	return count <= maxLogChunks && size <= limit
+}
+
+// Get envelope type
+func (e *envelopeLog) GetType() int {
+	return TypeLog
+}
+
+// Make sure the envelope is valid by analyzing the content in the
+// assigned storage, null will be returned on success, error with
+// validation result will be returned on failure.
+//
+// The whole chain of chunks is checked, each chunk must link to the
+// previous one and must be signed by the owner.
+func (e *envelopeLog) Validate() error {
+	return e.ValidateContext(context.Background(), nil)
+}
+
+// Validate the envelope, chunks are checked one by one as those are read
+// thus the memory used does not depend on the size of the log
+func (e *envelopeLog) ValidateContext(ctx context.Context, progress func(n int64)) error {
+
+	v := *e
+	v.storage = newValidationStorage(ctx, e.storage, progress)
+
+	var chain logChainValidator
+	pubKey, err := v.walkLog(func(pubKey ed25519.PublicKey, c *logChunk) error {
+		chain.pubKey = pubKey
+		return chain.check(c)
+	})
+	if err != nil {
+		return err
+	}
+	if pubKey == nil {
+		return ErrUninitialized
+	}
+
+	return nil
+}
+
+// Incremental validator of the log chain, chunks must be checked in order
+type logChainValidator struct {
+	pubKey   ed25519.PublicKey
+	index    uint64
+	prevHash []byte // Hash of the last checked chunk
+}
+
+// Check that the chunk links to the previous one and is signed by the owner
+func (v *logChainValidator) check(c *logChunk) error {
+
+	if !bytes.Equal(c.prevHash, v.prevHash) {
+		return ErrBrokenLogChain
+	}
+	v.prevHash = c.hash(v.index)
+	v.index++
+	if ed25519.VerifyWithOptions(v.pubKey, v.prevHash, c.signature, signedEnvelopeSignerOpts) != nil {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// Get the BID for this envelope, it's known even if there's
+// no content stored yet
+func (e *envelopeLog) GetBID() string {
+	return e.bid
+}
+
+// Get number of blob chunks contained within that envelope, only
+// chunks appended since the last call are read
+func (e *envelopeLog) GetChunksCount() int {
+	if err := e.refresh(); err != nil {
+		return 0
+	}
+	return len(e.verified)
+}
+
+// Get chunk reader, chunks are numbered in the order of appending
+func (e *envelopeLog) GetChunkReader(chunkNumber int) (reader io.Reader, err error) {
+
+	if chunkNumber < 0 {
+		return nil, ErrInvalidChunkNumber
+	}
+	if chunkNumber >= len(e.verified) {
+		if err = e.refresh(); err != nil {
+			return nil, err
+		}
+		if chunkNumber >= len(e.verified) {
+			return nil, ErrInvalidChunkNumber
+		}
+	}
+	info := e.verified[chunkNumber]
+
+	r, err := e.storage.GetBlobReader(e.bid)
+	if err != nil {
+		return nil, err
+	}
+	if err = skipLogData(r, info.offset); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return newChunkReader(io.LimitReader(r, info.size), r), nil
+}
+
+// Get writer to new chunk that will be appended at the end of the log
+//
+// The chunk is appended once the writer is closed, it links to the chunk
+// that is the last one at that time
+func (e *envelopeLog) GetNewChunkWriter() (writer io.WriteCloser, err error) {
+
+	if e.signingKey == nil {
+		return nil, ErrReadOnlyEnvelope
+	}
+
+	return &envelopeLogWriter{e: e}, nil
+}
+
+// Writer of the log chunk, the content is buffered until closed
+type envelopeLogWriter struct {
+	e      *envelopeLog
+	buffer bytes.Buffer
+}
+
+func (w *envelopeLogWriter) Write(p []byte) (n int, err error) {
+	if w.e == nil {
+		return 0, ErrWriterClosed
+	}
+	if w.buffer.Len()+len(p) > maxLogChunkSize {
+		return 0, ErrChunkTooLarge
+	}
+	return w.buffer.Write(p)
+}
+
+// Sign the chunk and append it to the log
+func (w *envelopeLogWriter) Close() error {
+	if w.e == nil {
+		return ErrWriterClosed
+	}
+	e := w.e
+	w.e = nil
+
+	if err := e.refresh(); err != nil {
+		return err
+	}
+
+	c := logChunk{content: w.buffer.Bytes(), prevHash: e.chain.prevHash}
+	signature, err := e.signingKey.Sign(nil, c.hash(e.chain.index), signedEnvelopeSignerOpts)
+	if err != nil {
+		return err
+	}
+	c.signature = signature
+
+	var b bytes.Buffer
+	c.write(&b)
+	if !e.fits(len(e.verified)+1, e.end-e.dataStart+int64(b.Len())) {
+		return ErrLogTooLarge
+	}
+
+	return e.appendLog(e.signingKey.Public().(ed25519.PublicKey), b.Bytes())
+}
+
+// Store the log extended with given serialized chunks. The storage can't
+// append to blobs thus verified chunks are copied to the new blob, the cost
+// of appending grows with the size of the log.
+func (e *envelopeLog) appendLog(pubKey ed25519.PublicKey, chunks []byte) error {
+
+	sw, err := e.storage.GetBlobWriter()
+	if err != nil {
+		return err
+	}
+
+	if e.pubKey == nil {
+		if err = utils.SerializeInt(TypeLog, sw); err == nil {
+			err = writeOwnerKey(sw, pubKey)
+		}
+	} else {
+		var r localstorage.Reader
+		if r, err = e.storage.GetBlobReader(e.bid); err == nil {
+			_, err = io.CopyN(sw, r, e.end)
+			r.Close()
+		}
+	}
+	if err == nil {
+		_, err = sw.Write(chunks)
+	}
+	if err != nil {
+		sw.Rollback()
+		return err
+	}
+
+	return sw.Commit(e.bid)
+}
+
+// Get named attribute, null will be returned for invalid name.
+// Standard attributes are supported together with "log.publicKey"
+// (ed25519.PublicKey).
+func (e *envelopeLog) GetAttribute(name string) interface{} {
+
+	// Size is known from verified chunks without reading them
+	if name == AttrSize {
+		if e.refresh() != nil || len(e.verified) == 0 {
+			return nil
+		}
+		var size int64
+		for _, info := range e.verified {
+			size += info.size
+		}
+		return size
+	}
+
+	if value, ok := standardAttribute(e, name); ok {
+		return value
+	}
+
+	if typeAttribute("log", name) != "publicKey" {
+		return nil
+	}
+	if e.signingKey != nil {
+		return e.signingKey.Public()
+	}
+
+	if e.refresh() != nil || e.pubKey == nil {
+		return nil
+	}
+	return e.pubKey
+}
+
+// Synchronize current blob with other node.
+//
+// The communicatino channel should be established between two
+// envelopes of exactly the same type. This method should be very
+// carefull though since the communication channel may be used to
+// perform various attacks on our node.
+func (e *envelopeLog) SynchronizeWithOtherNode(channel io.ReadWriteCloser, active bool) error {
+	return synchronize(e, channel, active)
+}
+
+// Number of chunks is the summary
+func (e *envelopeLog) syncSummary() (uint64, error) {
+	err := e.refresh()
+	return uint64(len(e.verified)), err
+}
+
+// Send the public key and all chunks the other node does not have,
+// serialized chunks are copied directly from the blob
+func (e *envelopeLog) writeSyncData(w io.Writer, peerSummary uint64) error {
+
+	if err := e.refresh(); err != nil {
+		return err
+	}
+	if peerSummary >= uint64(len(e.verified)) {
+		return ErrSyncProtocol
+	}
+
+	var b bytes.Buffer
+	if err := writeOwnerKey(&b, e.pubKey); err != nil {
+		return err
+	}
+	utils.SerializeInt(uint64(len(e.verified))-peerSummary, &b)
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return err
+	}
+
+	r, err := e.storage.GetBlobReader(e.bid)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	start := e.verified[peerSummary].start
+	if err = skipLogData(r, start); err != nil {
+		return err
+	}
+	_, err = io.CopyN(w, r, e.end-start)
+	return err
+}
+
+// Receive missing chunks, those must continue the verified chain
+func (e *envelopeLog) readSyncData(r io.Reader, peerSummary uint64) error {
+
+	pubKey, err := readOwnerKey(r, e.bid, e.cf)
+	if err != nil {
+		return err
+	}
+
+	if err = e.refresh(); err != nil {
+		return err
+	}
+
+	count, err := utils.DeserializeInt(r)
+	if err != nil {
+		return err
+	}
+	if count > maxLogChunks || uint64(len(e.verified))+count != peerSummary {
+		return ErrSyncProtocol
+	}
+
+	chain := e.chain
+	chain.pubKey = pubKey
+	var b bytes.Buffer
+	for i := uint64(0); i < count; i++ {
+		c, err := readLogChunk(r)
+		if err != nil {
+			return err
+		}
+		if err = chain.check(c); err != nil {
+			return err
+		}
+		c.write(&b)
+	}
+
+	if !e.fits(len(e.verified)+int(count), e.end-e.dataStart+int64(b.Len())) {
+		return ErrLogTooLarge
+	}
+
+	return e.appendLog(pubKey, b.Bytes())
+}
@@ -0,0 +1,226 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envelope
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/cinode/golib/localstorage"
+	"github.com/cinode/golib/utils"
+	"io"
+	"testing"
+)
+
+// Read the public key and all chunks of the log
+func (e *envelopeLog) readLog() (pubKey ed25519.PublicKey, chunks []logChunk, err error) {
+	pubKey, err = e.walkLog(func(pubKey ed25519.PublicKey, c *logChunk) error {
+		chunks = append(chunks, *c)
+		return nil
+	})
+	return pubKey, chunks, err
+}
+
+// Replace the log with given chunks, chunks verified so far are forgotten
+func (e *envelopeLog) writeLog(pubKey ed25519.PublicKey, chunks []logChunk) error {
+	var b bytes.Buffer
+	utils.SerializeInt(TypeLog, &b)
+	if err := writeOwnerKey(&b, pubKey); err != nil {
+		return err
+	}
+	for i := range chunks {
+		chunks[i].write(&b)
+	}
+	e.pubKey, e.verified, e.chain = nil, nil, logChainValidator{}
+	return storeBlob(e.storage, e.bid, b.Bytes())
+}
+
+// Storage counting bytes read from its blobs
+type readCountingStorage struct {
+	localstorage.Storage
+	n int64
+}
+
+type readCountingReader struct {
+	localstorage.Reader
+	s *readCountingStorage
+}
+
+func (s *readCountingStorage) GetBlobReader(blobID string) (localstorage.Reader, error) {
+	r, err := s.Storage.GetBlobReader(blobID)
+	if err != nil {
+		return nil, err
+	}
+	return &readCountingReader{Reader: r, s: s}, nil
+}
+
+func (r *readCountingReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	r.s.n += int64(n)
+	return
+}
+
+func (r *readCountingReader) Seek(offset int64, whence int) (int64, error) {
+	return r.Reader.(io.Seeker).Seek(offset, whence)
+}
+
+func TestLogAppend(t *testing.T) {
+	s := localstorage.InMemory()
+
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	noError(err, t)
+
+	e, err := NewLog(privKey, s, nil)
+	noError(err, t)
+	if tp := e.GetType(); tp != TypeLog {
+		t.Fatalf("Expected type: %v, got: %v", TypeLog, tp)
+	}
+	if cnt := e.GetChunksCount(); cnt != 0 {
+		t.Fatalf("Expected 0 chunks, got %v", cnt)
+	}
+	needError(e.Validate(), ErrUninitialized, t)
+
+	messages := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	for _, m := range messages {
+		writeChunk(e, m, t)
+	}
+	noError(e.Validate(), t)
+
+	e2, err := Open(e.GetBID(), s, nil)
+	noError(err, t)
+	if tp := e2.GetType(); tp != TypeLog {
+		t.Fatalf("Expected type: %v, got: %v", TypeLog, tp)
+	}
+	noError(e2.Validate(), t)
+	if cnt := e2.GetChunksCount(); cnt != len(messages) {
+		t.Fatalf("Expected %v chunks, got %v", len(messages), cnt)
+	}
+	for i, m := range messages {
+		if data := readChunk(e2, i, t); !bytes.Equal(data, m) {
+			t.Fatalf("Invalid content of chunk %v: %q", i, data)
+		}
+	}
+	_, err = e2.GetChunkReader(len(messages))
+	needError(err, ErrInvalidChunkNumber, t)
+	if k, ok := e2.GetAttribute("publicKey").(ed25519.PublicKey); !ok || !pubKey.Equal(k) {
+		t.Fatal("Invalid public key attribute")
+	}
+	_, err = e2.GetNewChunkWriter()
+	needError(err, ErrReadOnlyEnvelope, t)
+
+	// Too large chunk
+	w, err := e.GetNewChunkWriter()
+	noError(err, t)
+	_, err = w.Write(make([]byte, maxLogChunkSize+1))
+	needError(err, ErrChunkTooLarge, t)
+}
+
+func TestLogSizeLimit(t *testing.T) {
+	s := localstorage.InMemory()
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	noError(err, t)
+
+	e, err := NewLog(privKey, s, nil)
+	noError(err, t)
+	e.(*envelopeLog).sizeLimit = 208 // Serialized size of both chunks below
+
+	writeChunk(e, []byte("first"), t)
+	writeChunk(e, []byte("12345"), t)
+
+	// Appending beyond the limit must fail without changing the log
+	w, err := e.GetNewChunkWriter()
+	noError(err, t)
+	_, err = w.Write([]byte("x"))
+	noError(err, t)
+	needError(w.Close(), ErrLogTooLarge, t)
+	noError(e.Validate(), t)
+	if cnt := e.GetChunksCount(); cnt != 2 {
+		t.Fatalf("Expected 2 chunks, got %v", cnt)
+	}
+
+	// Synchronized data must fit into the limit as well
+	e2 := newEnvelopeLog(e.GetBID(), localstorage.InMemory(), nil)
+	e2.(*envelopeLog).sizeLimit = 100
+	errA, errP := syncPair(e, e2)
+	needError(errA, ErrSyncRejected, t)
+	needError(errP, ErrLogTooLarge, t)
+	if cnt := e2.GetChunksCount(); cnt != 0 {
+		t.Fatalf("Expected 0 chunks, got %v", cnt)
+	}
+}
+
+func TestLogChunksReadOnce(t *testing.T) {
+	s := localstorage.InMemory()
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	noError(err, t)
+	e, err := NewLog(privKey, s, nil)
+	noError(err, t)
+	const chunks = 50
+	for i := 0; i < chunks; i++ {
+		writeChunk(e, bytes.Repeat([]byte{byte(i)}, 100), t)
+	}
+	var size int
+	modifyBlob(s, e.GetBID(), func(data []byte) []byte {
+		size = len(data)
+		return data
+	}, t)
+
+	// Reading the whole log chunk by chunk must not read it again for each chunk
+	cs := &readCountingStorage{Storage: s}
+	e2 := newEnvelopeLog(e.GetBID(), cs, nil)
+	if cnt := e2.GetChunksCount(); cnt != chunks {
+		t.Fatalf("Expected %v chunks, got %v", chunks, cnt)
+	}
+	for i := 0; i < chunks; i++ {
+		if c := readChunk(e2, i, t); !bytes.Equal(c, bytes.Repeat([]byte{byte(i)}, 100)) {
+			t.Fatalf("Invalid content of chunk %v", i)
+		}
+	}
+	if size := e2.GetAttribute(AttrSize); size != int64(chunks*100) {
+		t.Fatalf("Invalid size: %v", size)
+	}
+	if cs.n > 3*int64(size) {
+		t.Fatalf("Read %v bytes of the log with %v bytes", cs.n, size)
+	}
+}
+
+func TestLogValidation(t *testing.T) {
+	s := localstorage.InMemory()
+
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	noError(err, t)
+	e, err := NewLog(privKey, s, nil)
+	noError(err, t)
+	for _, m := range []string{"first", "second", "third"} {
+		writeChunk(e, []byte(m), t)
+	}
+	l := e.(*envelopeLog)
+	_, chunks, err := l.readLog()
+	noError(err, t)
+
+	// Removed chunk
+	noError(l.writeLog(pubKey, []logChunk{chunks[0], chunks[2]}), t)
+	needError(e.Validate(), ErrBrokenLogChain, t)
+
+	// Reordered chunks
+	noError(l.writeLog(pubKey, []logChunk{chunks[1], chunks[0], chunks[2]}), t)
+	needError(e.Validate(), ErrBrokenLogChain, t)
+
+	// Modified content
+	modified := append([]logChunk{}, chunks...)
+	modified[1].content = []byte("modified")
+	noError(l.writeLog(pubKey, modified), t)
+	needError(e.Validate(), ErrInvalidSignature, t)
+
+	// Removed chunks at the beginning
+	noError(l.writeLog(pubKey, chunks[1:]), t)
+	needError(e.Validate(), ErrBrokenLogChain, t)
+
+	// Original chain is fine
+	noError(l.writeLog(pubKey, chunks), t)
+	noError(e.Validate(), t)
+}
@@ -0,0 +1,712 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"github.com/cinode/golib/cipherfactory"
+	"github.com/cinode/golib/localstorage"
+	"github.com/cinode/golib/utils"
+	"io"
+)
+
+const (
+	maxMultiSigSigners = 256
+)
+
+func init() {
+	RegisterType(TypeMultiSig, newEnvelopeMultiSig)
+}
+
+// Envelope with content that can be updated once approved by at least
+// threshold number of signers.
+//
+// The BID is derived from the set of signers' public keys and the
+// threshold, the only chunk carries the version and signatures of the
+// content. Content with higher version replaces the older one. Just like
+// for signed envelopes, the content must fit into the synchronization limit.
+type MultiSigEnvelope interface {
+	Envelope
+
+	// Set the version used by the next chunk writer, if not set, the version
+	// following the one currently stored is used
+	SetVersion(version uint64)
+
+	// Add the key used to sign the content of next chunk writers,
+	// the key must belong to one of the signers
+	AddSigningKey(signingKey ed25519.PrivateKey) error
+
+	// Add the signature created by other signer with SignMultiSig, it's
+	// used by the next chunk writer only. The signature is checked once
+	// the content is written.
+	AddSignature(pubKey ed25519.PublicKey, signature []byte) error
+}
+
+// Create multi-signature envelope requiring threshold of given signers to
+// approve the content, the BID is known right away
+func NewMultiSig(threshold int, signers []ed25519.PublicKey, storage localstorage.Storage, cf cipherfactory.Factory) (MultiSigEnvelope, error) {
+
+	cf = getCipherFactory(cf)
+
+	if threshold <= 0 {
+		return nil, ErrInvalidSignersPolicy
+	}
+	policy := &multiSigPolicy{threshold: uint64(threshold), signers: signers}
+	if err := policy.check(); err != nil {
+		return nil, err
+	}
+
+	bid, err := policy.bid(cf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &envelopeMultiSig{
+		bid:     bid,
+		storage: storage,
+		cf:      cf,
+		policy:  policy,
+	}, nil
+}
+
+// Sign the content of multi-signature envelope with given BID and version,
+// the signature can then be passed to the writer with AddSignature. It's
+// bound to the envelope thus it can't be used with other set of signers.
+func SignMultiSig(signingKey ed25519.PrivateKey, bid string, version uint64, content []byte) ([]byte, error) {
+	digest, err := multiSigDigest(bid, version, bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	return signingKey.Sign(nil, digest, signedEnvelopeSignerOpts)
+}
+
+func newEnvelopeMultiSig(bid string, storage localstorage.Storage, cf cipherfactory.Factory) Envelope {
+	return &envelopeMultiSig{bid: bid, storage: storage, cf: getCipherFactory(cf)}
+}
+
+type envelopeMultiSig struct {
+	bid         string
+	storage     localstorage.Storage
+	cf          cipherfactory.Factory
+	policy      *multiSigPolicy               // Signers and threshold, nil if not read yet
+	signingKeys map[uint64]ed25519.PrivateKey // Keys used to sign new content by signer index
+	signatures  map[uint64][]byte             // Signatures for the next chunk writer by signer index
+	version     uint64                        // Version used by the next chunk writer, 0 if not set
+}
+
+// Set of signers and the number of signatures required
+type multiSigPolicy struct {
+	threshold uint64
+	signers   []ed25519.PublicKey
+}
+
+// Make sure the policy can ever be fulfilled and that no key is counted twice
+func (p *multiSigPolicy) check() error {
+
+	if len(p.signers) == 0 || len(p.signers) > maxMultiSigSigners {
+		return ErrInvalidSignersPolicy
+	}
+	if p.threshold == 0 || p.threshold > uint64(len(p.signers)) {
+		return ErrInvalidSignersPolicy
+	}
+
+	for i, k := range p.signers {
+		if len(k) != ed25519.PublicKeySize {
+			return ErrInvalidSignersPolicy
+		}
+		for _, k2 := range p.signers[:i] {
+			if k.Equal(k2) {
+				return ErrInvalidSignersPolicy
+			}
+		}
+	}
+
+	return nil
+}
+
+// Serialize the policy, it's stored right after the type
+func (p *multiSigPolicy) write(w io.Writer) error {
+	utils.SerializeInt(p.threshold, w)
+	utils.SerializeInt(uint64(len(p.signers)), w)
+	for _, k := range p.signers {
+		if err := writeOwnerKey(w, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calculate the BID of envelope with this policy, it's the hash
+// of the serialized policy
+func (p *multiSigPolicy) bid(cf cipherfactory.Factory) (string, error) {
+
+	hasher, err := cipherfactory.NewBIDHasher(cf)
+	if err != nil {
+		return "", err
+	}
+	if err = p.write(hasher); err != nil {
+		return "", err
+	}
+	return hasher.BID(), nil
+}
+
+// Get the index of given signer, -1 is returned if the key is not a signer
+func (p *multiSigPolicy) signerIndex(pubKey ed25519.PublicKey) int {
+	for i, k := range p.signers {
+		if k.Equal(pubKey) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Read the policy, it must match the BID
+func readMultiSigPolicy(r io.Reader, bid string, cf cipherfactory.Factory) (*multiSigPolicy, error) {
+
+	hasher, err := cipherfactory.NewBIDHasherFor(cf, bid)
+	if err != nil {
+		return nil, err
+	}
+	tr := io.TeeReader(r, hasher)
+
+	threshold, err := utils.DeserializeInt(tr)
+	if err != nil {
+		return nil, err
+	}
+	count, err := utils.DeserializeInt(tr)
+	if err != nil {
+		return nil, err
+	}
+	if count > maxMultiSigSigners {
+		return nil, ErrInvalidSignersPolicy
+	}
+
+	policy := &multiSigPolicy{threshold: threshold}
+	for i := uint64(0); i < count; i++ {
+		pubKeyRaw, err := utils.DeserializeBuffer(tr, maxPublicKeyLength)
+		if err != nil {
+			return nil, err
+		}
+		pubKey, err := parsePublicKey(pubKeyRaw)
+		if err != nil {
+			return nil, err
+		}
+		policy.signers = append(policy.signers, pubKey)
+	}
+
+	if hasher.BID() != bid {
+		return nil, ErrInvalidPublicKeyBID
+	}
+	if err = policy.check(); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// Signature of one of the signers
+type multiSigSignature struct {
+	signer    uint64 // Index of the signer in the policy
+	signature []byte
+}
+
+// Header of the multi-signature envelope blob, stored right after the type
+type multiSigHeader struct {
+	policy     *multiSigPolicy
+	version    uint64
+	signatures []multiSigSignature // Ordered by the signer index
+}
+
+// Read the envelope header, returned reader is positioned at the content
+func (e *envelopeMultiSig) readHeader() (*multiSigHeader, localstorage.Reader, error) {
+
+	r, err := e.storage.GetBlobReader(e.bid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hdr, err := readMultiSigHeader(r, e.bid, e.cf)
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return hdr, r, nil
+}
+
+// Read the header of the multi-signature envelope from the blob reader
+func readMultiSigHeader(r io.Reader, bid string, cf cipherfactory.Factory) (*multiSigHeader, error) {
+
+	t, err := utils.DeserializeInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if t != TypeMultiSig {
+		return nil, ErrInvalidEnvelopeType
+	}
+
+	policy, err := readMultiSigPolicy(r, bid, cf)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := utils.DeserializeInt(r)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := utils.DeserializeInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(policy.signers)) {
+		return nil, ErrInvalidSignature
+	}
+
+	hdr := &multiSigHeader{policy: policy, version: version}
+	for i := uint64(0); i < count; i++ {
+		var s multiSigSignature
+		if s.signer, err = utils.DeserializeInt(r); err != nil {
+			return nil, err
+		}
+		if s.signer >= uint64(len(policy.signers)) {
+			return nil, ErrUnknownSigner
+		}
+
+		// Strict ordering guarantees no signer is counted twice
+		if i > 0 && s.signer <= hdr.signatures[i-1].signer {
+			return nil, ErrInvalidSignature
+		}
+
+		if s.signature, err = utils.DeserializeBuffer(r, maxSignatureLength); err != nil {
+			return nil, err
+		}
+		hdr.signatures = append(hdr.signatures, s)
+	}
+
+	return hdr, nil
+}
+
+// Calculate the digest signed by each signer: type, BID, version and content,
+// the BID covers the policy so signatures can't be replayed in other envelopes
+func multiSigDigest(bid string, version uint64, content io.Reader) ([]byte, error) {
+	hasher := sha512.New()
+	utils.SerializeInt(TypeMultiSig, hasher)
+	if err := utils.SerializeString(bid, hasher, maxSyncBIDLength); err != nil {
+		return nil, err
+	}
+	utils.SerializeInt(version, hasher)
+	if _, err := io.Copy(hasher, content); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+// Get envelope type
+func (e *envelopeMultiSig) GetType() int {
+	return TypeMultiSig
+}
+
+// Make sure the envelope is valid by analyzing the content in the
+// assigned storage, null will be returned on success, error with
+// validation result will be returned on failure.
+//
+// Every stored signature must be valid and there must be at least
+// threshold number of them.
+func (e *envelopeMultiSig) Validate() error {
+	return e.ValidateContext(context.Background(), nil)
+}
+
+// Validate the envelope, all signatures are checked once the content is read
+func (e *envelopeMultiSig) ValidateContext(ctx context.Context, progress func(n int64)) error {
+	v := *e
+	v.storage = newValidationStorage(ctx, e.storage, progress)
+	return v.validate()
+}
+
+func (e *envelopeMultiSig) validate() error {
+
+	hdr, r, err := e.readHeader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	digest, err := multiSigDigest(e.bid, hdr.version, r)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range hdr.signatures {
+		pubKey := hdr.policy.signers[s.signer]
+		if ed25519.VerifyWithOptions(pubKey, digest, s.signature, signedEnvelopeSignerOpts) != nil {
+			return ErrInvalidSignature
+		}
+	}
+
+	if uint64(len(hdr.signatures)) < hdr.policy.threshold {
+		return ErrNotEnoughSignatures
+	}
+
+	return nil
+}
+
+// Get the BID for this envelope, it's known even if there's
+// no content stored yet
+func (e *envelopeMultiSig) GetBID() string {
+	return e.bid
+}
+
+// Get number of blob chunks contained within that envelope
+func (e *envelopeMultiSig) GetChunksCount() int {
+	r, err := e.storage.GetBlobReader(e.bid)
+	if err != nil {
+		return 0
+	}
+	r.Close()
+	return 1
+}
+
+// Get chunk reader
+func (e *envelopeMultiSig) GetChunkReader(chunkNumber int) (reader io.Reader, err error) {
+
+	if chunkNumber != 0 || e.GetChunksCount() == 0 {
+		return nil, ErrInvalidChunkNumber
+	}
+
+	_, r, err := e.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	return newChunkReader(r, r), nil
+}
+
+// Set the version used by the next chunk writer
+func (e *envelopeMultiSig) SetVersion(version uint64) {
+	e.version = version
+}
+
+// Get the header of currently stored content, nil if there's none
+func (e *envelopeMultiSig) currentHeader() (*multiSigHeader, error) {
+	if e.GetChunksCount() == 0 {
+		return nil, nil
+	}
+	hdr, r, err := e.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	r.Close()
+	return hdr, nil
+}
+
+// Get the policy of the envelope, if not known yet,
+// it's read from the stored content
+func (e *envelopeMultiSig) getPolicy() (*multiSigPolicy, error) {
+	if e.policy != nil {
+		return e.policy, nil
+	}
+	hdr, r, err := e.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	r.Close()
+	e.policy = hdr.policy
+	return e.policy, nil
+}
+
+// Find the index of the signer owning given key
+func (e *envelopeMultiSig) signerIndex(pubKey ed25519.PublicKey) (uint64, error) {
+	policy, err := e.getPolicy()
+	if err != nil {
+		return 0, err
+	}
+	idx := policy.signerIndex(pubKey)
+	if idx < 0 {
+		return 0, ErrUnknownSigner
+	}
+	return uint64(idx), nil
+}
+
+// Add the key used to sign new content
+func (e *envelopeMultiSig) AddSigningKey(signingKey ed25519.PrivateKey) error {
+	idx, err := e.signerIndex(signingKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		return err
+	}
+	if e.signingKeys == nil {
+		e.signingKeys = make(map[uint64]ed25519.PrivateKey)
+	}
+	e.signingKeys[idx] = signingKey
+	return nil
+}
+
+// Add the signature used by the next chunk writer
+func (e *envelopeMultiSig) AddSignature(pubKey ed25519.PublicKey, signature []byte) error {
+	idx, err := e.signerIndex(pubKey)
+	if err != nil {
+		return err
+	}
+	if len(signature) > maxSignatureLength {
+		return ErrInvalidSignature
+	}
+	if e.signatures == nil {
+		e.signatures = make(map[uint64][]byte)
+	}
+	e.signatures[idx] = signature
+	return nil
+}
+
+// Get writer to new chunk that will replace the current content
+//
+// The content is signed with all signing keys and stored together with
+// added signatures once the writer is closed. It's refused if its version
+// is not higher than the one currently stored or if there are not enough
+// valid signatures.
+func (e *envelopeMultiSig) GetNewChunkWriter() (writer io.WriteCloser, err error) {
+
+	policy, err := e.getPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	// Signing keys and signatures of the same signer are counted once
+	signers := len(e.signatures)
+	for idx := range e.signingKeys {
+		if _, ok := e.signatures[idx]; !ok {
+			signers++
+		}
+	}
+	if uint64(signers) < policy.threshold {
+		return nil, ErrNotEnoughSignatures
+	}
+
+	hdr, err := e.currentHeader()
+	if err != nil {
+		return nil, err
+	}
+	var current uint64
+	if hdr != nil {
+		current = hdr.version
+	}
+
+	version := e.version
+	if version == 0 {
+		version = current + 1
+	}
+	if version <= current {
+		return nil, ErrVersionTooLow
+	}
+
+	w := &envelopeMultiSigWriter{
+		e:           e,
+		version:     version,
+		signingKeys: make(map[uint64]ed25519.PrivateKey),
+		signatures:  e.signatures,
+	}
+	for idx, k := range e.signingKeys {
+		w.signingKeys[idx] = k
+	}
+
+	// Signatures are bound to the version, those can't be reused
+	e.version = 0
+	e.signatures = nil
+
+	return w, nil
+}
+
+// Writer of the multi-signature envelope content, the content is buffered
+// since the signatures must be stored before it
+type envelopeMultiSigWriter struct {
+	e           *envelopeMultiSig
+	version     uint64
+	signingKeys map[uint64]ed25519.PrivateKey
+	signatures  map[uint64][]byte
+	buffer      bytes.Buffer
+}
+
+func (w *envelopeMultiSigWriter) Write(p []byte) (n int, err error) {
+	if w.e == nil {
+		return 0, ErrWriterClosed
+	}
+	if w.buffer.Len()+len(p) > maxEnvelopeContentSize {
+		return 0, ErrChunkTooLarge
+	}
+	return w.buffer.Write(p)
+}
+
+// Sign the content and store it replacing older version
+func (w *envelopeMultiSigWriter) Close() error {
+	if w.e == nil {
+		return ErrWriterClosed
+	}
+	e := w.e
+	w.e = nil
+
+	// Other writer could have stored newer content in the meantime
+	hdr, err := e.currentHeader()
+	if err != nil {
+		return err
+	}
+	if hdr != nil && w.version <= hdr.version {
+		return ErrVersionTooLow
+	}
+
+	digest, err := multiSigDigest(e.bid, w.version, bytes.NewReader(w.buffer.Bytes()))
+	if err != nil {
+		return err
+	}
+
+	// Collect signatures ordered by the signer index, own keys take
+	// precedence over signatures created elsewhere
+	var signatures []multiSigSignature
+	for idx, pubKey := range e.policy.signers {
+		s := multiSigSignature{signer: uint64(idx)}
+		if k, ok := w.signingKeys[s.signer]; ok {
+			if s.signature, err = k.Sign(nil, digest, signedEnvelopeSignerOpts); err != nil {
+				return err
+			}
+		} else if sig, ok := w.signatures[s.signer]; ok {
+			if ed25519.VerifyWithOptions(pubKey, digest, sig, signedEnvelopeSignerOpts) != nil {
+				return ErrInvalidSignature
+			}
+			s.signature = sig
+		} else {
+			continue
+		}
+		signatures = append(signatures, s)
+	}
+	if uint64(len(signatures)) < e.policy.threshold {
+		return ErrNotEnoughSignatures
+	}
+
+	var header bytes.Buffer
+	utils.SerializeInt(TypeMultiSig, &header)
+	if err = e.policy.write(&header); err != nil {
+		return err
+	}
+	utils.SerializeInt(w.version, &header)
+	utils.SerializeInt(uint64(len(signatures)), &header)
+	for _, s := range signatures {
+		utils.SerializeInt(s.signer, &header)
+		utils.SerializeBuffer(s.signature, &header, maxSignatureLength)
+	}
+
+	sw, err := e.storage.GetBlobWriter()
+	if err != nil {
+		return err
+	}
+	if _, err = sw.Write(header.Bytes()); err != nil {
+		sw.Rollback()
+		return err
+	}
+	if _, err = sw.Write(w.buffer.Bytes()); err != nil {
+		sw.Rollback()
+		return err
+	}
+
+	return sw.Commit(e.bid)
+}
+
+// Get named attribute, null will be returned for invalid name
+// or if there's no content stored yet. Standard attributes are supported
+// together with "multisig.version" (uint64), "multisig.threshold" (int),
+// "multisig.publicKeys" (all signers, []ed25519.PublicKey) and
+// "multisig.signers" (keys that signed the stored content,
+// []ed25519.PublicKey).
+func (e *envelopeMultiSig) GetAttribute(name string) interface{} {
+
+	if value, ok := standardAttribute(e, name); ok {
+		return value
+	}
+
+	name = typeAttribute("multisig", name)
+	switch name {
+	case "version", "threshold", "publicKeys", "signers":
+	default:
+		return nil
+	}
+
+	// Policy is known without the content for the creator
+	if e.policy != nil {
+		switch name {
+		case "threshold":
+			return int(e.policy.threshold)
+		case "publicKeys":
+			return e.policy.signers
+		}
+	}
+
+	if e.GetChunksCount() == 0 {
+		return nil
+	}
+	hdr, r, err := e.readHeader()
+	if err != nil {
+		return nil
+	}
+	r.Close()
+
+	switch name {
+	case "version":
+		return hdr.version
+	case "threshold":
+		return int(hdr.policy.threshold)
+	case "publicKeys":
+		return hdr.policy.signers
+	}
+
+	signers := make([]ed25519.PublicKey, 0, len(hdr.signatures))
+	for _, s := range hdr.signatures {
+		signers = append(signers, hdr.policy.signers[s.signer])
+	}
+	return signers
+}
+
+// Synchronize current blob with other node.
+//
+// The communicatino channel should be established between two
+// envelopes of exactly the same type. This method should be very
+// carefull though since the communication channel may be used to
+// perform various attacks on our node.
+func (e *envelopeMultiSig) SynchronizeWithOtherNode(channel io.ReadWriteCloser, active bool) error {
+	return synchronize(e, channel, active)
+}
+
+// Version of the stored content is the summary
+func (e *envelopeMultiSig) syncSummary() (uint64, error) {
+	hdr, err := e.currentHeader()
+	if err != nil || hdr == nil {
+		return 0, err
+	}
+	return hdr.version, nil
+}
+
+func (e *envelopeMultiSig) writeSyncData(w io.Writer, peerSummary uint64) error {
+	return writeSyncBlob(w, e.storage, e.bid)
+}
+
+func (e *envelopeMultiSig) readSyncData(r io.Reader, peerSummary uint64) error {
+	return readSyncBlob(r, e.storage, e.bid, func(tmp localstorage.Storage) error {
+		received := &envelopeMultiSig{bid: e.bid, storage: tmp, cf: e.cf}
+		if err := received.Validate(); err != nil {
+			return err
+		}
+
+		// Make sure we don't replace newer content
+		receivedHdr, err := received.currentHeader()
+		if err != nil {
+			return err
+		}
+		hdr, err := e.currentHeader()
+		if err != nil {
+			return err
+		}
+		if receivedHdr.version != peerSummary || (hdr != nil && receivedHdr.version <= hdr.version) {
+			return ErrVersionTooLow
+		}
+		return nil
+	})
+}
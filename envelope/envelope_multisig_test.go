@@ -0,0 +1,241 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envelope
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/cinode/golib/localstorage"
+	"testing"
+)
+
+func generateSigners(n int, t *testing.T) ([]ed25519.PublicKey, []ed25519.PrivateKey) {
+	var pubKeys []ed25519.PublicKey
+	var privKeys []ed25519.PrivateKey
+	for i := 0; i < n; i++ {
+		pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+		noError(err, t)
+		pubKeys = append(pubKeys, pubKey)
+		privKeys = append(privKeys, privKey)
+	}
+	return pubKeys, privKeys
+}
+
+func TestMultiSigPolicy(t *testing.T) {
+	s := localstorage.InMemory()
+	pubKeys, _ := generateSigners(3, t)
+
+	for _, threshold := range []int{-1, 0, 4} {
+		_, err := NewMultiSig(threshold, pubKeys, s, nil)
+		needError(err, ErrInvalidSignersPolicy, t)
+	}
+	_, err := NewMultiSig(1, nil, s, nil)
+	needError(err, ErrInvalidSignersPolicy, t)
+	_, err = NewMultiSig(2, []ed25519.PublicKey{pubKeys[0], pubKeys[0]}, s, nil)
+	needError(err, ErrInvalidSignersPolicy, t)
+
+	// BID commits to both the keys and the threshold
+	e1, err := NewMultiSig(2, pubKeys, s, nil)
+	noError(err, t)
+	e2, err := NewMultiSig(2, pubKeys, s, nil)
+	noError(err, t)
+	e3, err := NewMultiSig(3, pubKeys, s, nil)
+	noError(err, t)
+	e4, err := NewMultiSig(2, pubKeys[:2], s, nil)
+	noError(err, t)
+	if e1.GetBID() != e2.GetBID() {
+		t.Fatal("BID must depend on the policy only")
+	}
+	if e1.GetBID() == e3.GetBID() || e1.GetBID() == e4.GetBID() {
+		t.Fatal("Different policies must give different BIDs")
+	}
+}
+
+func TestMultiSigWriteReadCycle(t *testing.T) {
+	s := localstorage.InMemory()
+	pubKeys, privKeys := generateSigners(3, t)
+	_, outsider := generateSigners(1, t)
+
+	e, err := NewMultiSig(2, pubKeys, s, nil)
+	noError(err, t)
+	if tp := e.GetType(); tp != TypeMultiSig {
+		t.Fatalf("Expected type: %v, got: %v", TypeMultiSig, tp)
+	}
+	if th := e.GetAttribute("threshold"); th != 2 {
+		t.Fatalf("Invalid threshold: %v", th)
+	}
+	if v := e.GetAttribute("version"); v != nil {
+		t.Fatalf("Unexpected version of empty envelope: %v", v)
+	}
+
+	needError(e.AddSigningKey(outsider[0]), ErrUnknownSigner, t)
+
+	// Single signature is not enough
+	noError(e.AddSigningKey(privKeys[0]), t)
+	_, err = e.GetNewChunkWriter()
+	needError(err, ErrNotEnoughSignatures, t)
+
+	// Signature created by other signer
+	sig, err := SignMultiSig(privKeys[2], e.GetBID(), 1, []byte("release 1"))
+	noError(err, t)
+	noError(e.AddSignature(pubKeys[2], sig), t)
+	writeChunk(e, []byte("release 1"), t)
+	noError(e.Validate(), t)
+
+	signers, ok := e.GetAttribute("signers").([]ed25519.PublicKey)
+	if !ok || len(signers) != 2 || !signers[0].Equal(pubKeys[0]) || !signers[1].Equal(pubKeys[2]) {
+		t.Fatalf("Invalid signers: %v", signers)
+	}
+
+	// External signatures are bound to the version
+	_, err = e.GetNewChunkWriter()
+	needError(err, ErrNotEnoughSignatures, t)
+
+	// Signature of different content is refused
+	sig, err = SignMultiSig(privKeys[1], e.GetBID(), 2, []byte("other"))
+	noError(err, t)
+	noError(e.AddSignature(pubKeys[1], sig), t)
+	w, err := e.GetNewChunkWriter()
+	noError(err, t)
+	w.Write([]byte("release 2"))
+	needError(w.Close(), ErrInvalidSignature, t)
+
+	// Co-signer opens the envelope by BID and writes new version
+	e2, err := Open(e.GetBID(), s, nil)
+	noError(err, t)
+	m2 := e2.(MultiSigEnvelope)
+	noError(m2.AddSigningKey(privKeys[1]), t)
+	noError(m2.AddSigningKey(privKeys[2]), t)
+	m2.SetVersion(1)
+	_, err = m2.GetNewChunkWriter()
+	needError(err, ErrVersionTooLow, t)
+	m2.SetVersion(2)
+	writeChunk(m2, []byte("release 2"), t)
+	noError(e.Validate(), t)
+
+	if v := e.GetAttribute("version"); v != uint64(2) {
+		t.Fatalf("Invalid version: %v", v)
+	}
+	if data := readChunk(e, 0, t); !bytes.Equal(data, []byte("release 2")) {
+		t.Fatalf("Invalid chunk content: %q", data)
+	}
+	signers, ok = e.GetAttribute("signers").([]ed25519.PublicKey)
+	if !ok || len(signers) != 2 || !signers[0].Equal(pubKeys[1]) || !signers[1].Equal(pubKeys[2]) {
+		t.Fatalf("Invalid signers: %v", signers)
+	}
+	if keys, ok := e2.GetAttribute("publicKeys").([]ed25519.PublicKey); !ok || len(keys) != 3 {
+		t.Fatalf("Invalid public keys: %v", keys)
+	}
+}
+
+func TestMultiSigReplay(t *testing.T) {
+	s := localstorage.InMemory()
+	pubKeys, privKeys := generateSigners(3, t)
+
+	// Envelopes sharing the first signer
+	e1, err := NewMultiSig(1, pubKeys[:2], s, nil)
+	noError(err, t)
+	e2, err := NewMultiSig(1, []ed25519.PublicKey{pubKeys[0], pubKeys[2]}, s, nil)
+	noError(err, t)
+
+	content := []byte("content")
+	sig1, err := SignMultiSig(privKeys[0], e1.GetBID(), 1, content)
+	noError(err, t)
+	sig2, err := SignMultiSig(privKeys[0], e2.GetBID(), 1, content)
+	noError(err, t)
+	if bytes.Equal(sig1, sig2) {
+		t.Fatal("Signature is not bound to the envelope")
+	}
+
+	// Signature created for other envelope is refused by the writer
+	noError(e2.AddSignature(pubKeys[0], sig1), t)
+	w, err := e2.GetNewChunkWriter()
+	noError(err, t)
+	w.Write(content)
+	needError(w.Close(), ErrInvalidSignature, t)
+
+	// Signature replayed from other envelope is refused by the validation
+	noError(e2.AddSignature(pubKeys[0], sig2), t)
+	writeChunk(e2, content, t)
+	noError(e2.Validate(), t)
+	modifyBlob(s, e2.GetBID(), func(data []byte) []byte {
+		return bytes.Replace(data, sig2, sig1, 1)
+	}, t)
+	needError(e2.Validate(), ErrInvalidSignature, t)
+}
+
+func TestMultiSigValidation(t *testing.T) {
+	s := localstorage.InMemory()
+	pubKeys, privKeys := generateSigners(3, t)
+
+	e, err := NewMultiSig(2, pubKeys, s, nil)
+	noError(err, t)
+	for _, k := range privKeys {
+		noError(e.AddSigningKey(k), t)
+	}
+	writeChunk(e, []byte("content"), t)
+	noError(e.Validate(), t)
+
+	original := readChunk(e, 0, t)
+	var blob []byte
+	modifyBlob(s, e.GetBID(), func(data []byte) []byte {
+		blob = append([]byte{}, data...)
+		return data
+	}, t)
+	restore := func() {
+		noError(storeBlob(s, e.GetBID(), blob), t)
+	}
+
+	// Modified content
+	modifyBlob(s, e.GetBID(), func(data []byte) []byte {
+		data[len(data)-1] ^= 1
+		return data
+	}, t)
+	needError(e.Validate(), ErrInvalidSignature, t)
+	restore()
+
+	// Signature removed - the count, index and signature of the last
+	// signer are dropped, two are still enough
+	hdrLen := len(blob) - len(original)
+	sigLen := 1 + 1 + ed25519.SignatureSize
+	countPos := hdrLen - 3*sigLen - 1
+	modifyBlob(s, e.GetBID(), func(data []byte) []byte {
+		out := append([]byte{}, data[:countPos]...)
+		out = append(out, 2)
+		out = append(out, data[countPos+1:hdrLen-sigLen]...)
+		return append(out, original...)
+	}, t)
+	noError(e.Validate(), t)
+	if signers := e.GetAttribute("signers").([]ed25519.PublicKey); len(signers) != 2 {
+		t.Fatalf("Invalid number of signers: %v", len(signers))
+	}
+
+	// Only one signature left
+	modifyBlob(s, e.GetBID(), func(data []byte) []byte {
+		out := append([]byte{}, blob[:countPos]...)
+		out = append(out, 1)
+		out = append(out, blob[countPos+1:hdrLen-2*sigLen]...)
+		return append(out, original...)
+	}, t)
+	needError(e.Validate(), ErrNotEnoughSignatures, t)
+
+	// The same signer counted twice
+	modifyBlob(s, e.GetBID(), func(data []byte) []byte {
+		out := append([]byte{}, blob[:countPos]...)
+		out = append(out, 2)
+		out = append(out, blob[countPos+1:hdrLen-2*sigLen]...)
+		out = append(out, blob[countPos+1:hdrLen-2*sigLen]...)
+		return append(out, original...)
+	}, t)
+	needError(e.Validate(), ErrInvalidSignature, t)
+
+	// Policy not matching the BID
+	restore()
+	e2, err := NewMultiSig(1, pubKeys, s, nil)
+	noError(err, t)
+	noError(storeBlob(s, e2.GetBID(), blob), t)
+	needError(e2.Validate(), ErrInvalidPublicKeyBID, t)
+}
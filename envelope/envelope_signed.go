@@ -0,0 +1,567 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"crypto/x509"
+	"github.com/cinode/golib/cipherfactory"
+	"github.com/cinode/golib/localstorage"
+	"github.com/cinode/golib/utils"
+	"io"
+	"time"
+)
+
+const (
+	maxPublicKeyLength = 1024
+	maxSignatureLength = 1024
+)
+
+func init() {
+	RegisterType(TypeSigned, newEnvelopeSigned)
+}
+
+// Envelope with content that can be updated by the owner of the signing key.
+//
+// The BID is derived from the public key, the only chunk carries the version
+// and the signature of the content. Content with higher version replaces
+// the older one. The size of the content is limited so that the whole
+// envelope can be sent during synchronization.
+type SignedEnvelope interface {
+	Envelope
+
+	// Set the version used by the next chunk writer, if not set, the version
+	// following the one currently stored is used
+	SetVersion(version uint64)
+
+	// Withdraw the content by replacing it with a signed tombstone using
+	// the next version. Revoked envelope can not be modified any more and
+	// its content can't be read.
+	Revoke() error
+}
+
+// Create signed envelope owned by given key, the BID is known right away
+func NewSigned(signingKey ed25519.PrivateKey, storage localstorage.Storage, cf cipherfactory.Factory) (SignedEnvelope, error) {
+
+	cf = getCipherFactory(cf)
+
+	bid, err := ownerBID(signingKey, cf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &envelopeSigned{
+		bid:        bid,
+		storage:    storage,
+		cf:         cf,
+		signingKey: signingKey,
+	}, nil
+}
+
+func newEnvelopeSigned(bid string, storage localstorage.Storage, cf cipherfactory.Factory) Envelope {
+	return &envelopeSigned{bid: bid, storage: storage, cf: getCipherFactory(cf)}
+}
+
+type envelopeSigned struct {
+	bid        string
+	storage    localstorage.Storage
+	cf         cipherfactory.Factory
+	signingKey ed25519.PrivateKey // Key used to sign new content, nil if read-only
+	version    uint64             // Version used by the next chunk writer, 0 if not set
+}
+
+const (
+	signedFlagRevoked = 1 << iota // Envelope is a tombstone of revoked content
+	signedFlagCreated             // Creation time is stored after the flags
+
+	signedFlagsMask = signedFlagRevoked | signedFlagCreated
+)
+
+// Header of the signed envelope blob, stored right after the type
+type signedHeader struct {
+	pubKey    ed25519.PublicKey
+	version   uint64
+	flags     uint64
+	created   int64 // Unix time of the creation, valid if signedFlagCreated is set
+	signature []byte
+}
+
+func (h *signedHeader) revoked() bool {
+	return h.flags&signedFlagRevoked != 0
+}
+
+// Options used for signatures, the content is streamed thus prehashed
+var signedEnvelopeSignerOpts = &ed25519.Options{Hash: crypto.SHA512}
+
+// Read the envelope header, returned reader is positioned at the content
+func (e *envelopeSigned) readHeader() (*signedHeader, localstorage.Reader, error) {
+
+	r, err := e.storage.GetBlobReader(e.bid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hdr, err := readSignedHeader(r, e.bid, e.cf)
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return hdr, r, nil
+}
+
+// Read the header of the signed envelope from the blob reader
+func readSignedHeader(r io.Reader, bid string, cf cipherfactory.Factory) (*signedHeader, error) {
+
+	t, err := utils.DeserializeInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if t != TypeSigned {
+		return nil, ErrInvalidEnvelopeType
+	}
+
+	pubKey, err := readOwnerKey(r, bid, cf)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := utils.DeserializeInt(r)
+	if err != nil {
+		return nil, err
+	}
+
+	flags, err := utils.DeserializeInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if flags&^signedFlagsMask != 0 {
+		return nil, ErrInvalidFlags
+	}
+
+	hdr := &signedHeader{pubKey: pubKey, version: version, flags: flags}
+	if flags&signedFlagCreated != 0 {
+		created, err := utils.DeserializeInt(r)
+		if err != nil {
+			return nil, err
+		}
+		hdr.created = int64(created)
+	}
+
+	if hdr.signature, err = utils.DeserializeBuffer(r, maxSignatureLength); err != nil {
+		return nil, err
+	}
+
+	return hdr, nil
+}
+
+// Calculate the BID of envelope owned by given key, it's the hash
+// of the serialized public key
+func ownerBID(signingKey ed25519.PrivateKey, cf cipherfactory.Factory) (string, error) {
+
+	pubKey, err := x509.MarshalPKIXPublicKey(signingKey.Public())
+	if err != nil {
+		return "", err
+	}
+
+	hasher, err := cipherfactory.NewBIDHasher(cf)
+	if err != nil {
+		return "", err
+	}
+	hasher.Write(pubKey)
+	return hasher.BID(), nil
+}
+
+// Serialize the public key of the owner
+func writeOwnerKey(w io.Writer, pubKey ed25519.PublicKey) error {
+	pubKeyRaw, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return err
+	}
+	return utils.SerializeBuffer(pubKeyRaw, w, maxPublicKeyLength)
+}
+
+// Read the public key of the owner, the key must match the BID
+func readOwnerKey(r io.Reader, bid string, cf cipherfactory.Factory) (ed25519.PublicKey, error) {
+
+	pubKeyRaw, err := utils.DeserializeBuffer(r, maxPublicKeyLength)
+	if err != nil {
+		return nil, err
+	}
+
+	// BID must be equal to the hash of the public key
+	hasher, err := cipherfactory.NewBIDHasherFor(cf, bid)
+	if err != nil {
+		return nil, err
+	}
+	hasher.Write(pubKeyRaw)
+	if hasher.BID() != bid {
+		return nil, ErrInvalidPublicKeyBID
+	}
+
+	return parsePublicKey(pubKeyRaw)
+}
+
+// Parse the serialized public key, only Ed25519 keys are supported
+func parsePublicKey(pubKeyRaw []byte) (ed25519.PublicKey, error) {
+	pubKeyParsed, err := x509.ParsePKIXPublicKey(pubKeyRaw)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, ok := pubKeyParsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, ErrUnknownPublicKeyType
+	}
+	return pubKey, nil
+}
+
+// Calculate the digest of the signed data: type, version, flags,
+// creation time (if present) and content
+func signedDigest(hdr *signedHeader, content io.Reader) ([]byte, error) {
+	hasher := sha512.New()
+	utils.SerializeInt(TypeSigned, hasher)
+	utils.SerializeInt(hdr.version, hasher)
+	utils.SerializeInt(hdr.flags, hasher)
+	if hdr.flags&signedFlagCreated != 0 {
+		utils.SerializeInt(uint64(hdr.created), hasher)
+	}
+	if _, err := io.Copy(hasher, content); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+// Get envelope type
+func (e *envelopeSigned) GetType() int {
+	return TypeSigned
+}
+
+// Make sure the envelope is valid by analyzing the content in the
+// assigned storage, null will be returned on success, error with
+// validation result will be returned on failure. Properly signed
+// tombstone is valid so that it can be propagated to other nodes.
+func (e *envelopeSigned) Validate() error {
+	return e.ValidateContext(context.Background(), nil)
+}
+
+// Validate the envelope, the signature is checked once the content is read
+func (e *envelopeSigned) ValidateContext(ctx context.Context, progress func(n int64)) error {
+	v := *e
+	v.storage = newValidationStorage(ctx, e.storage, progress)
+	return v.validate()
+}
+
+func (e *envelopeSigned) validate() error {
+
+	hdr, r, err := e.readHeader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	digest, err := signedDigest(hdr, r)
+	if err != nil {
+		return err
+	}
+
+	if ed25519.VerifyWithOptions(hdr.pubKey, digest, hdr.signature, signedEnvelopeSignerOpts) != nil {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// Get the BID for this envelope, it's known even if there's
+// no content stored yet
+func (e *envelopeSigned) GetBID() string {
+	return e.bid
+}
+
+// Get number of blob chunks contained within that envelope
+func (e *envelopeSigned) GetChunksCount() int {
+	r, err := e.storage.GetBlobReader(e.bid)
+	if err != nil {
+		return 0
+	}
+	r.Close()
+	return 1
+}
+
+// Get chunk reader
+func (e *envelopeSigned) GetChunkReader(chunkNumber int) (reader io.Reader, err error) {
+
+	if chunkNumber != 0 || e.GetChunksCount() == 0 {
+		return nil, ErrInvalidChunkNumber
+	}
+
+	hdr, r, err := e.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.revoked() {
+		r.Close()
+		return nil, ErrRevoked
+	}
+	return newChunkReader(r, r), nil
+}
+
+// Set the version used by the next chunk writer
+func (e *envelopeSigned) SetVersion(version uint64) {
+	e.version = version
+}
+
+// Get the header of currently stored content, nil if there's none
+func (e *envelopeSigned) currentHeader() (*signedHeader, error) {
+	if e.GetChunksCount() == 0 {
+		return nil, nil
+	}
+	hdr, r, err := e.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	r.Close()
+	return hdr, nil
+}
+
+// Get the version for new content, the one set with SetVersion
+// or the one following the version currently stored
+func (e *envelopeSigned) nextVersion() (uint64, error) {
+
+	if e.signingKey == nil {
+		return 0, ErrReadOnlyEnvelope
+	}
+
+	hdr, err := e.currentHeader()
+	if err != nil {
+		return 0, err
+	}
+	var current uint64
+	if hdr != nil {
+		if hdr.revoked() {
+			return 0, ErrRevoked
+		}
+		current = hdr.version
+	}
+
+	version := e.version
+	if version == 0 {
+		version = current + 1
+	}
+	if version <= current {
+		return 0, ErrVersionTooLow
+	}
+	e.version = 0
+
+	return version, nil
+}
+
+// Get writer to new chunk that will replace the current content
+//
+// The content is stored once the writer is closed, it's refused
+// if its version is not higher than the one currently stored
+func (e *envelopeSigned) GetNewChunkWriter() (writer io.WriteCloser, err error) {
+
+	version, err := e.nextVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	return &envelopeSignedWriter{e: e, version: version}, nil
+}
+
+// Replace the content with a tombstone
+func (e *envelopeSigned) Revoke() error {
+
+	version, err := e.nextVersion()
+	if err != nil {
+		return err
+	}
+
+	return e.store(version, signedFlagRevoked, nil)
+}
+
+// Writer of the signed envelope content, the content is buffered
+// since the signature must be stored before it
+type envelopeSignedWriter struct {
+	e       *envelopeSigned
+	version uint64
+	buffer  bytes.Buffer
+}
+
+func (w *envelopeSignedWriter) Write(p []byte) (n int, err error) {
+	if w.e == nil {
+		return 0, ErrWriterClosed
+	}
+	if w.buffer.Len()+len(p) > maxEnvelopeContentSize {
+		return 0, ErrChunkTooLarge
+	}
+	return w.buffer.Write(p)
+}
+
+// Sign the content and store it replacing older version
+func (w *envelopeSignedWriter) Close() error {
+	if w.e == nil {
+		return ErrWriterClosed
+	}
+	e := w.e
+	w.e = nil
+
+	return e.store(w.version, 0, w.buffer.Bytes())
+}
+
+// Sign the content and store it replacing older version
+func (e *envelopeSigned) store(version, flags uint64, content []byte) error {
+
+	// Other writer could have stored newer content in the meantime
+	hdr, err := e.currentHeader()
+	if err != nil {
+		return err
+	}
+	if hdr != nil && hdr.revoked() {
+		return ErrRevoked
+	}
+	if hdr != nil && version <= hdr.version {
+		return ErrVersionTooLow
+	}
+
+	newHdr := &signedHeader{
+		version: version,
+		flags:   flags | signedFlagCreated,
+		created: now().Unix(),
+	}
+	digest, err := signedDigest(newHdr, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	signature, err := e.signingKey.Sign(nil, digest, signedEnvelopeSignerOpts)
+	if err != nil {
+		return err
+	}
+
+	var header bytes.Buffer
+	utils.SerializeInt(TypeSigned, &header)
+	if err = writeOwnerKey(&header, e.signingKey.Public().(ed25519.PublicKey)); err != nil {
+		return err
+	}
+	utils.SerializeInt(newHdr.version, &header)
+	utils.SerializeInt(newHdr.flags, &header)
+	utils.SerializeInt(uint64(newHdr.created), &header)
+	utils.SerializeBuffer(signature, &header, maxSignatureLength)
+
+	sw, err := e.storage.GetBlobWriter()
+	if err != nil {
+		return err
+	}
+	if _, err = sw.Write(header.Bytes()); err != nil {
+		sw.Rollback()
+		return err
+	}
+	if _, err = sw.Write(content); err != nil {
+		sw.Rollback()
+		return err
+	}
+
+	return sw.Commit(e.bid)
+}
+
+// Get named attribute, null will be returned for invalid name
+// or if there's no content stored yet. Standard attributes are supported
+// together with "signed.version" (uint64), "signed.publicKey"
+// (ed25519.PublicKey) and "signed.revoked" (bool).
+func (e *envelopeSigned) GetAttribute(name string) interface{} {
+
+	if name != AttrCreated {
+		if value, ok := standardAttribute(e, name); ok {
+			return value
+		}
+	}
+
+	name = typeAttribute("signed", name)
+	switch name {
+	case AttrCreated, "version", "publicKey", "revoked":
+	default:
+		return nil
+	}
+
+	// Public key is known without the content for the owner
+	if name == "publicKey" && e.signingKey != nil {
+		return e.signingKey.Public()
+	}
+
+	if e.GetChunksCount() == 0 {
+		return nil
+	}
+	hdr, r, err := e.readHeader()
+	if err != nil {
+		return nil
+	}
+	r.Close()
+
+	switch name {
+	case AttrCreated:
+		if hdr.flags&signedFlagCreated == 0 {
+			return nil
+		}
+		return time.Unix(hdr.created, 0)
+	case "version":
+		return hdr.version
+	case "revoked":
+		return hdr.revoked()
+	}
+	return hdr.pubKey
+}
+
+// Synchronize current blob with other node.
+//
+// The communicatino channel should be established between two
+// envelopes of exactly the same type. This method should be very
+// carefull though since the communication channel may be used to
+// perform various attacks on our node.
+func (e *envelopeSigned) SynchronizeWithOtherNode(channel io.ReadWriteCloser, active bool) error {
+	return synchronize(e, channel, active)
+}
+
+// Version of the stored content is the summary
+func (e *envelopeSigned) syncSummary() (uint64, error) {
+	hdr, err := e.currentHeader()
+	if err != nil || hdr == nil {
+		return 0, err
+	}
+	return hdr.version, nil
+}
+
+func (e *envelopeSigned) writeSyncData(w io.Writer, peerSummary uint64) error {
+	return writeSyncBlob(w, e.storage, e.bid)
+}
+
+func (e *envelopeSigned) readSyncData(r io.Reader, peerSummary uint64) error {
+	return readSyncBlob(r, e.storage, e.bid, func(tmp localstorage.Storage) error {
+		received := &envelopeSigned{bid: e.bid, storage: tmp, cf: e.cf}
+		if err := received.Validate(); err != nil {
+			return err
+		}
+
+		// Make sure we don't replace newer content, revoked
+		// content can't be replaced at all
+		receivedHdr, err := received.currentHeader()
+		if err != nil {
+			return err
+		}
+		hdr, err := e.currentHeader()
+		if err != nil {
+			return err
+		}
+		if hdr != nil && hdr.revoked() {
+			return ErrRevoked
+		}
+		if receivedHdr.version != peerSummary || (hdr != nil && receivedHdr.version <= hdr.version) {
+			return ErrVersionTooLow
+		}
+		return nil
+	})
+}
@@ -0,0 +1,204 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envelope
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/cinode/golib/localstorage"
+	"github.com/cinode/golib/utils"
+	"io/ioutil"
+	"testing"
+)
+
+func writeChunk(e Envelope, data []byte, t *testing.T) {
+	w, err := e.GetNewChunkWriter()
+	noError(err, t)
+	_, err = w.Write(data)
+	noError(err, t)
+	noError(w.Close(), t)
+}
+
+func readChunk(e Envelope, n int, t *testing.T) []byte {
+	r, err := e.GetChunkReader(n)
+	noError(err, t)
+	data, err := ioutil.ReadAll(r)
+	noError(err, t)
+	return data
+}
+
+// Replace the blob in the storage with modified content
+func modifyBlob(s localstorage.Storage, bid string, modify func([]byte) []byte, t *testing.T) {
+	r, err := s.GetBlobReader(bid)
+	noError(err, t)
+	data, err := ioutil.ReadAll(r)
+	noError(err, t)
+	r.Close()
+
+	w, err := s.GetBlobWriter()
+	noError(err, t)
+	w.Write(modify(data))
+	noError(w.Commit(bid), t)
+}
+
+func TestSignedWriteReadCycle(t *testing.T) {
+	s := localstorage.InMemory()
+
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	noError(err, t)
+
+	e, err := NewSigned(privKey, s, nil)
+	noError(err, t)
+
+	if tp := e.GetType(); tp != TypeSigned {
+		t.Fatalf("Expected type: %v, got: %v", TypeSigned, tp)
+	}
+	if e.GetBID() == "" {
+		t.Fatal("BID of signed envelope must be known before writing")
+	}
+	if cnt := e.GetChunksCount(); cnt != 0 {
+		t.Fatalf("Expected 0 chunks, got %v", cnt)
+	}
+	if v := e.GetAttribute("version"); v != nil {
+		t.Fatalf("Unexpected version of empty envelope: %v", v)
+	}
+	if k, ok := e.GetAttribute("publicKey").(ed25519.PublicKey); !ok || !pubKey.Equal(k) {
+		t.Fatal("Invalid public key attribute")
+	}
+
+	writeChunk(e, []byte("hello"), t)
+	noError(e.Validate(), t)
+	if v := e.GetAttribute("version"); v != uint64(1) {
+		t.Fatalf("Invalid version: %v", v)
+	}
+	if cnt := e.GetChunksCount(); cnt != 1 {
+		t.Fatalf("Expected 1 chunk, got %v", cnt)
+	}
+
+	// Lower or equal version must be refused
+	e.SetVersion(1)
+	_, err = e.GetNewChunkWriter()
+	needError(err, ErrVersionTooLow, t)
+
+	e.SetVersion(5)
+	writeChunk(e, []byte("hello world"), t)
+	noError(e.Validate(), t)
+	if v := e.GetAttribute("version"); v != uint64(5) {
+		t.Fatalf("Invalid version: %v", v)
+	}
+
+	// Open without the key
+	e2, err := Open(e.GetBID(), s, nil)
+	noError(err, t)
+	if tp := e2.GetType(); tp != TypeSigned {
+		t.Fatalf("Expected type: %v, got: %v", TypeSigned, tp)
+	}
+	noError(e2.Validate(), t)
+	if data := readChunk(e2, 0, t); !bytes.Equal(data, []byte("hello world")) {
+		t.Fatalf("Invalid chunk content: %q", data)
+	}
+	if k, ok := e2.GetAttribute("publicKey").(ed25519.PublicKey); !ok || !pubKey.Equal(k) {
+		t.Fatal("Invalid public key attribute")
+	}
+	if v := e2.GetAttribute("unknown"); v != nil {
+		t.Fatalf("Unexpected value of unknown attribute: %v", v)
+	}
+	_, err = e2.GetNewChunkWriter()
+	needError(err, ErrReadOnlyEnvelope, t)
+	_, err = e2.GetChunkReader(1)
+	needError(err, ErrInvalidChunkNumber, t)
+
+	// Writer outdated by newer content
+	w, err := e.GetNewChunkWriter()
+	noError(err, t)
+	e.SetVersion(10)
+	writeChunk(e, []byte("newest"), t)
+	w.Write([]byte("outdated"))
+	needError(w.Close(), ErrVersionTooLow, t)
+	if data := readChunk(e2, 0, t); !bytes.Equal(data, []byte("newest")) {
+		t.Fatalf("Invalid chunk content: %q", data)
+	}
+}
+
+func TestSignedValidation(t *testing.T) {
+	s := localstorage.InMemory()
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	noError(err, t)
+	e, err := NewSigned(privKey, s, nil)
+	noError(err, t)
+	writeChunk(e, []byte("hello"), t)
+
+	// Modified content
+	modifyBlob(s, e.GetBID(), func(data []byte) []byte {
+		data[len(data)-1] ^= 0x01
+		return data
+	}, t)
+	needError(e.Validate(), ErrInvalidSignature, t)
+
+	// Content signed by other key
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	noError(err, t)
+	other, err := NewSigned(otherKey, s, nil)
+	noError(err, t)
+	writeChunk(other, []byte("hello"), t)
+	modifyBlob(s, e.GetBID(), func([]byte) []byte {
+		r, err := s.GetBlobReader(other.GetBID())
+		noError(err, t)
+		data, err := ioutil.ReadAll(r)
+		noError(err, t)
+		return data
+	}, t)
+	needError(e.Validate(), ErrInvalidPublicKeyBID, t)
+}
+
+func TestSignedRevoke(t *testing.T) {
+	s := localstorage.InMemory()
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	noError(err, t)
+
+	e, err := NewSigned(privKey, s, nil)
+	noError(err, t)
+
+	writeChunk(e, []byte("hello"), t)
+	if r := e.GetAttribute("revoked"); r != false {
+		t.Fatalf("Invalid revoked attribute: %v", r)
+	}
+
+	noError(e.Revoke(), t)
+	noError(e.Validate(), t)
+	if r := e.GetAttribute("revoked"); r != true {
+		t.Fatalf("Invalid revoked attribute: %v", r)
+	}
+	if v := e.GetAttribute("version"); v != uint64(2) {
+		t.Fatalf("Invalid version: %v", v)
+	}
+
+	// Readers must not see the content any more
+	e2, err := Open(e.GetBID(), s, nil)
+	noError(err, t)
+	noError(e2.Validate(), t)
+	_, err = e2.GetChunkReader(0)
+	needError(err, ErrRevoked, t)
+
+	// Revoked envelope can not be modified
+	e.SetVersion(10)
+	_, err = e.GetNewChunkWriter()
+	needError(err, ErrRevoked, t)
+	needError(e.Revoke(), ErrRevoked, t)
+
+	// Unknown flags must be rejected, flags follow the owner key and version
+	modifyBlob(s, e.GetBID(), func(data []byte) []byte {
+		var prefix bytes.Buffer
+		utils.SerializeInt(TypeSigned, &prefix)
+		noError(writeOwnerKey(&prefix, privKey.Public().(ed25519.PublicKey)), t)
+		utils.SerializeInt(2, &prefix)
+		data[prefix.Len()] |= 0x40
+		return data
+	}, t)
+	needError(e.Validate(), ErrInvalidFlags, t)
+}
@@ -7,4 +7,33 @@ var (
 	ErrUninitialized       = errors.New("Chunk has not been initialized properly")
 	ErrInvalidEnvelopeType = errors.New("Invalid envelope type")
 	ErrInvalidHashBID      = errors.New("Invalid hash-based blob, BID mismatch")
+	ErrTooManyChunks       = errors.New("Envelope can not hold any more chunks")
+	ErrWriterClosed        = errors.New("Chunk writer has already been closed")
+
+	ErrEnvelopeTypeRegistered = errors.New("Envelope type has already been registered")
+
+	ErrInvalidPublicKeyBID  = errors.New("Invalid public key - does not match blob id")
+	ErrUnknownPublicKeyType = errors.New("Unknown public key type")
+	ErrInvalidSignature     = errors.New("Invalid envelope signature")
+	ErrReadOnlyEnvelope     = errors.New("Envelope can not be modified without the signing key")
+	ErrVersionTooLow        = errors.New("Version must be higher than the one already stored")
+	ErrBrokenLogChain       = errors.New("Log chunk does not link to the previous one")
+	ErrChunkTooLarge        = errors.New("Chunk is too large")
+	ErrLogTooLarge          = errors.New("Log can not hold any more data")
+
+	ErrSyncMismatch     = errors.New("Envelopes being synchronized do not match")
+	ErrSyncProtocol     = errors.New("Invalid synchronization message received")
+	ErrSyncRejected     = errors.New("Data has been rejected by the other node")
+	ErrSyncTimeout      = errors.New("Synchronization timed out")
+	ErrSyncDataTooLarge = errors.New("Too much data received during synchronization")
+
+	ErrExpired               = errors.New("Envelope has expired")
+	ErrInvalidExpirationTime = errors.New("Invalid expiration time")
+
+	ErrRevoked      = errors.New("Envelope content has been revoked by the owner")
+	ErrInvalidFlags = errors.New("Invalid envelope flags")
+
+	ErrInvalidSignersPolicy = errors.New("Invalid set of signers or threshold")
+	ErrUnknownSigner        = errors.New("Key is not one of the envelope signers")
+	ErrNotEnoughSignatures  = errors.New("Not enough signatures to reach the threshold")
 )
@@ -0,0 +1,92 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envelope
+
+import (
+	"github.com/cinode/golib/cipherfactory"
+	"github.com/cinode/golib/localstorage"
+	"github.com/cinode/golib/utils"
+	"sync"
+)
+
+// Constructor of envelopes of given type, the bid is empty when creating
+// new envelope, otherwise it identifies existing blob in the storage
+type Constructor func(bid string, storage localstorage.Storage, cf cipherfactory.Factory) Envelope
+
+var (
+	envelopeTypes     = make(map[uint64]Constructor)
+	envelopeTypesLock sync.RWMutex
+)
+
+// Register new envelope type, once registered, envelopes of that type
+// can be created and opened
+func RegisterType(envelopeType int, constructor Constructor) error {
+
+	if envelopeType <= 0 || constructor == nil {
+		return ErrInvalidEnvelopeType
+	}
+
+	envelopeTypesLock.Lock()
+	defer envelopeTypesLock.Unlock()
+
+	if _, exists := envelopeTypes[uint64(envelopeType)]; exists {
+		return ErrEnvelopeTypeRegistered
+	}
+	envelopeTypes[uint64(envelopeType)] = constructor
+	return nil
+}
+
+// Find the constructor for given envelope type, nil is returned if not found
+func getConstructor(envelopeType uint64) Constructor {
+	envelopeTypesLock.RLock()
+	defer envelopeTypesLock.RUnlock()
+	return envelopeTypes[envelopeType]
+}
+
+// Get the cipher factory to use, the default one is returned if none is given
+func getCipherFactory(cf cipherfactory.Factory) cipherfactory.Factory {
+	if cf == nil {
+		return cipherfactory.Create()
+	}
+	return cf
+}
+
+// Create new envelope of given type, the default cipher factory
+// is used if cf is nil
+func New(envelopeType int, storage localstorage.Storage, cf cipherfactory.Factory) (Envelope, error) {
+
+	if envelopeType <= 0 {
+		return nil, ErrInvalidEnvelopeType
+	}
+	constructor := getConstructor(uint64(envelopeType))
+	if constructor == nil {
+		return nil, ErrInvalidEnvelopeType
+	}
+
+	return constructor("", storage, getCipherFactory(cf)), nil
+}
+
+// Open existing envelope, the type is detected from the blob content.
+// The envelope is not validated, use Validate to check it.
+func Open(bid string, storage localstorage.Storage, cf cipherfactory.Factory) (Envelope, error) {
+
+	r, err := storage.GetBlobReader(bid)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	envelopeType, err := utils.DeserializeInt(r)
+	if err != nil {
+		return nil, err
+	}
+
+	constructor := getConstructor(envelopeType)
+	if constructor == nil {
+		return nil, ErrInvalidEnvelopeType
+	}
+
+	return constructor(bid, storage, getCipherFactory(cf)), nil
+}
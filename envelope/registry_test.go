@@ -0,0 +1,64 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envelope
+
+import (
+	"bytes"
+	"github.com/cinode/golib/localstorage"
+	"io/ioutil"
+	"testing"
+)
+
+func TestNewOpen(t *testing.T) {
+	s := localstorage.InMemory()
+
+	_, err := New(0, s, nil)
+	needError(err, ErrInvalidEnvelopeType, t)
+	_, err = New(0x7F, s, nil)
+	needError(err, ErrInvalidEnvelopeType, t)
+
+	e, err := New(TypeHash, s, nil)
+	noError(err, t)
+	if tp := e.GetType(); tp != TypeHash {
+		t.Fatalf("Expected type: %v, got: %v", TypeHash, tp)
+	}
+
+	w, err := e.GetNewChunkWriter()
+	noError(err, t)
+	w.Write([]byte("hello world"))
+	noError(w.Close(), t)
+
+	e2, err := Open(e.GetBID(), s, nil)
+	noError(err, t)
+	if tp := e2.GetType(); tp != TypeHash {
+		t.Fatalf("Expected type: %v, got: %v", TypeHash, tp)
+	}
+	noError(e2.Validate(), t)
+
+	r, err := e2.GetChunkReader(0)
+	noError(err, t)
+	data, err := ioutil.ReadAll(r)
+	noError(err, t)
+	if !bytes.Equal(data, []byte("hello world")) {
+		t.Fatalf("Invalid chunk content: %q", data)
+	}
+
+	// Blob of unknown type
+	wr, err := s.GetBlobWriter()
+	noError(err, t)
+	wr.Write([]byte{0x7F, 0x00})
+	noError(wr.Commit("unknown"), t)
+	_, err = Open("unknown", s, nil)
+	needError(err, ErrInvalidEnvelopeType, t)
+
+	_, err = Open("missing", s, nil)
+	needError(err, localstorage.ErrNoSuchBlob, t)
+}
+
+func TestRegisterType(t *testing.T) {
+	needError(RegisterType(0, newEnvelopeHash), ErrInvalidEnvelopeType, t)
+	needError(RegisterType(0x7E, nil), ErrInvalidEnvelopeType, t)
+	needError(RegisterType(TypeHash, newEnvelopeHash), ErrEnvelopeTypeRegistered, t)
+}
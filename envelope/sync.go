@@ -0,0 +1,281 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envelope
+
+import (
+	"bytes"
+	"github.com/cinode/golib/localstorage"
+	"github.com/cinode/golib/utils"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Synchronization protocol
+//
+// Both nodes hold an envelope with the same BID and type. Each side
+// describes its local state with a summary number, higher summary means
+// newer data (chunks count for hash and log envelopes, version for signed
+// ones). All numbers are varints, strings and buffers are prefixed with
+// their length.
+//
+// Active node sends:
+//   protocol version, BID, envelope type, summary
+// Passive node replies with:
+//   status, summary (only if status is OK)
+// The node with the higher summary sends the data the other one is missing,
+// the format is specific to the envelope type. The receiving node validates
+// the data, stores it and replies with:
+//   status
+//
+// Nothing is transferred if both summaries are equal. The data is limited
+// to maxSyncDataSize bytes, envelopes never hold more content than that.
+
+const (
+	syncProtocolVersion = 1
+
+	syncStatusOK       = 0
+	syncStatusMismatch = 1
+	syncStatusRejected = 2
+
+	maxSyncBIDLength = 1024
+	maxSyncDataSize  = 32 * 1024 * 1024
+
+	// Maximum size of the content of envelopes, whole blobs are sent during
+	// synchronization thus the rest of the sync limit is left for headers
+	maxEnvelopeContentSize = maxSyncDataSize - 256*1024
+)
+
+// Maximum time the whole synchronization may take
+var syncTimeout = 30 * time.Second
+
+// Envelope that can be synchronized with other node
+type syncable interface {
+	Envelope
+
+	// Get the summary of the local state, 0 if there's no data stored
+	syncSummary() (uint64, error)
+
+	// Send data that is missing on the other node
+	writeSyncData(w io.Writer, peerSummary uint64) error
+
+	// Receive data from the other node, it must be validated
+	// before it's stored
+	readSyncData(r io.Reader, peerSummary uint64) error
+}
+
+// Reader failing once too much data has been read
+type syncLimitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *syncLimitedReader) Read(p []byte) (n int, err error) {
+	if l.n <= 0 {
+		return 0, ErrSyncDataTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err = l.r.Read(p)
+	l.n -= int64(n)
+	return
+}
+
+// Synchronize the envelope with other node over given channel,
+// the channel is closed once done
+func synchronize(e syncable, channel io.ReadWriteCloser, active bool) (err error) {
+
+	// Closing the channel will break any pending read or write
+	var timedOut int32
+	timer := time.AfterFunc(syncTimeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		channel.Close()
+	})
+	defer func() {
+		timer.Stop()
+		channel.Close()
+		if atomic.LoadInt32(&timedOut) != 0 {
+			err = ErrSyncTimeout
+		}
+	}()
+
+	// Limit the amount of data the other node can make us read,
+	// the overhead accounts for the protocol messages
+	r := &syncLimitedReader{r: channel, n: maxSyncDataSize + 64*1024}
+	w := channel
+
+	localSummary, err := e.syncSummary()
+	if err != nil {
+		return err
+	}
+
+	var peerSummary uint64
+	if active {
+		peerSummary, err = syncHandshakeActive(e, r, w, localSummary)
+	} else {
+		peerSummary, err = syncHandshakePassive(e, r, w, localSummary)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case localSummary > peerSummary:
+		return syncSend(e, r, w, peerSummary)
+	case localSummary < peerSummary:
+		return syncReceive(e, r, w, peerSummary)
+	}
+	return nil
+}
+
+func syncHandshakeActive(e syncable, r io.Reader, w io.Writer, localSummary uint64) (uint64, error) {
+
+	if e.GetBID() == "" {
+		return 0, ErrUninitialized
+	}
+
+	var hello bytes.Buffer
+	utils.SerializeInt(syncProtocolVersion, &hello)
+	utils.SerializeString(e.GetBID(), &hello, maxSyncBIDLength)
+	utils.SerializeInt(uint64(e.GetType()), &hello)
+	utils.SerializeInt(localSummary, &hello)
+	if _, err := w.Write(hello.Bytes()); err != nil {
+		return 0, err
+	}
+
+	status, err := utils.DeserializeInt(r)
+	if err != nil {
+		return 0, err
+	}
+	switch status {
+	case syncStatusOK:
+	case syncStatusMismatch:
+		return 0, ErrSyncMismatch
+	default:
+		return 0, ErrSyncProtocol
+	}
+
+	return utils.DeserializeInt(r)
+}
+
+func syncHandshakePassive(e syncable, r io.Reader, w io.Writer, localSummary uint64) (uint64, error) {
+
+	version, err := utils.DeserializeInt(r)
+	if err != nil {
+		return 0, err
+	}
+	bid, err := utils.DeserializeString(r, maxSyncBIDLength)
+	if err != nil {
+		return 0, err
+	}
+	envelopeType, err := utils.DeserializeInt(r)
+	if err != nil {
+		return 0, err
+	}
+	peerSummary, err := utils.DeserializeInt(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if version != syncProtocolVersion || bid != e.GetBID() || bid == "" || envelopeType != uint64(e.GetType()) {
+		utils.SerializeInt(syncStatusMismatch, w)
+		return 0, ErrSyncMismatch
+	}
+
+	var reply bytes.Buffer
+	utils.SerializeInt(syncStatusOK, &reply)
+	utils.SerializeInt(localSummary, &reply)
+	if _, err = w.Write(reply.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return peerSummary, nil
+}
+
+// Send missing data and wait for the confirmation
+func syncSend(e syncable, r io.Reader, w io.Writer, peerSummary uint64) error {
+
+	if err := e.writeSyncData(w, peerSummary); err != nil {
+		return err
+	}
+
+	status, err := utils.DeserializeInt(r)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case syncStatusOK:
+		return nil
+	case syncStatusRejected:
+		return ErrSyncRejected
+	}
+	return ErrSyncProtocol
+}
+
+// Receive missing data and confirm it
+func syncReceive(e syncable, r io.Reader, w io.Writer, peerSummary uint64) error {
+
+	if err := e.readSyncData(r, peerSummary); err != nil {
+		utils.SerializeInt(syncStatusRejected, w)
+		return err
+	}
+
+	return utils.SerializeInt(syncStatusOK, w)
+}
+
+// Send the whole blob of the envelope
+func writeSyncBlob(w io.Writer, storage localstorage.Storage, bid string) error {
+
+	r, err := storage.GetBlobReader(bid)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var data bytes.Buffer
+	if _, err = io.Copy(&data, io.LimitReader(r, maxSyncDataSize+1)); err != nil {
+		return err
+	}
+	return utils.SerializeBuffer(data.Bytes(), w, maxSyncDataSize)
+}
+
+// Receive the whole blob of the envelope and store it if it's valid,
+// validation is done on a temporary copy of the blob
+func readSyncBlob(
+	r io.Reader,
+	storage localstorage.Storage,
+	bid string,
+	validate func(tmp localstorage.Storage) error,
+) error {
+
+	data, err := utils.DeserializeBuffer(r, maxSyncDataSize)
+	if err != nil {
+		return err
+	}
+
+	tmp := localstorage.InMemory()
+	if err = storeBlob(tmp, bid, data); err != nil {
+		return err
+	}
+	if err = validate(tmp); err != nil {
+		return err
+	}
+
+	return storeBlob(storage, bid, data)
+}
+
+// Store the blob data in the storage
+func storeBlob(storage localstorage.Storage, bid string, data []byte) error {
+	w, err := storage.GetBlobWriter()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		w.Rollback()
+		return err
+	}
+	return w.Commit(bid)
+}
@@ -0,0 +1,316 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envelope
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/cinode/golib/localstorage"
+	"github.com/cinode/golib/utils"
+	"net"
+	"testing"
+	"time"
+)
+
+// Synchronize two envelopes over a pipe, returns errors of active
+// and passive side
+func syncPair(active, passive Envelope) (errActive, errPassive error) {
+	c1, c2 := net.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- passive.SynchronizeWithOtherNode(c2, false)
+	}()
+	errActive = active.SynchronizeWithOtherNode(c1, true)
+	errPassive = <-done
+	return
+}
+
+func TestSyncHash(t *testing.T) {
+	s1, s2 := localstorage.InMemory(), localstorage.InMemory()
+
+	e1, err := New(TypeHash, s1, nil)
+	noError(err, t)
+	writeChunk(e1, []byte("hello world"), t)
+
+	e2, err := newEnvelopeHash(e1.GetBID(), s2, nil), nil
+	needError(e2.Validate(), localstorage.ErrNoSuchBlob, t)
+
+	// Passive node receives the data
+	errA, errP := syncPair(e1, e2)
+	noError(errA, t)
+	noError(errP, t)
+	noError(e2.Validate(), t)
+	if data := readChunk(e2, 0, t); !bytes.Equal(data, []byte("hello world")) {
+		t.Fatalf("Invalid chunk content: %q", data)
+	}
+
+	// Nothing to do if both nodes have the data
+	errA, errP = syncPair(e2, e1)
+	noError(errA, t)
+	noError(errP, t)
+
+	// Active node receives the data
+	s3 := localstorage.InMemory()
+	e3 := newEnvelopeHash(e1.GetBID(), s3, nil)
+	errA, errP = syncPair(e3, e1)
+	noError(errA, t)
+	noError(errP, t)
+	noError(e3.Validate(), t)
+}
+
+func TestSyncLargeEnvelopes(t *testing.T) {
+	s1, s2 := localstorage.InMemory(), localstorage.InMemory()
+
+	// Larger content can't be stored
+	e1, err := New(TypeHash, s1, nil)
+	noError(err, t)
+	w, err := e1.GetNewChunkWriter()
+	noError(err, t)
+	_, err = w.Write(make([]byte, maxEnvelopeContentSize+1))
+	needError(err, ErrChunkTooLarge, t)
+	needError(w.Close(), ErrChunkTooLarge, t)
+	if blobIds, _ := s1.(localstorage.Lister).ListBlobs(); len(blobIds) != 0 {
+		t.Fatalf("Too large envelope stored: %v", blobIds)
+	}
+
+	// Largest content can be synchronized
+	data := make([]byte, maxEnvelopeContentSize)
+	data[len(data)-1] = 1
+	writeChunk(e1, data, t)
+
+	e2 := newEnvelopeHash(e1.GetBID(), s2, nil)
+	errA, errP := syncPair(e1, e2)
+	noError(errA, t)
+	noError(errP, t)
+	noError(e2.Validate(), t)
+}
+
+func TestSyncHashInvalidData(t *testing.T) {
+	s1, s2 := localstorage.InMemory(), localstorage.InMemory()
+
+	e1, err := New(TypeHash, s1, nil)
+	noError(err, t)
+	writeChunk(e1, []byte("hello world"), t)
+	modifyBlob(s1, e1.GetBID(), func(data []byte) []byte {
+		data[len(data)-1] ^= 0x01
+		return data
+	}, t)
+
+	e2 := newEnvelopeHash(e1.GetBID(), s2, nil)
+	errA, errP := syncPair(e1, e2)
+	needError(errA, ErrSyncRejected, t)
+	needError(errP, ErrInvalidHashBID, t)
+	if _, err = s2.GetBlobReader(e1.GetBID()); err != localstorage.ErrNoSuchBlob {
+		t.Fatalf("Invalid data has been stored: %v", err)
+	}
+}
+
+func TestSyncSigned(t *testing.T) {
+	s1, s2 := localstorage.InMemory(), localstorage.InMemory()
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	noError(err, t)
+
+	e1, err := NewSigned(privKey, s1, nil)
+	noError(err, t)
+	e2, err := NewSigned(privKey, s2, nil)
+	noError(err, t)
+
+	e1.SetVersion(3)
+	writeChunk(e1, []byte("version 3"), t)
+	writeChunk(e2, []byte("version 1"), t)
+
+	// Newer version replaces the older one
+	errA, errP := syncPair(e2, e1)
+	noError(errA, t)
+	noError(errP, t)
+	if data := readChunk(e2, 0, t); !bytes.Equal(data, []byte("version 3")) {
+		t.Fatalf("Invalid chunk content: %q", data)
+	}
+	if v := e2.GetAttribute("version"); v != uint64(3) {
+		t.Fatalf("Invalid version: %v", v)
+	}
+
+	// Read-only node receives the data too
+	s3 := localstorage.InMemory()
+	e3 := newEnvelopeSigned(e1.GetBID(), s3, nil)
+	errA, errP = syncPair(e1, e3)
+	noError(errA, t)
+	noError(errP, t)
+	noError(e3.Validate(), t)
+}
+
+func TestSyncLog(t *testing.T) {
+	s1, s2 := localstorage.InMemory(), localstorage.InMemory()
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	noError(err, t)
+
+	e1, err := NewLog(privKey, s1, nil)
+	noError(err, t)
+	for _, m := range []string{"first", "second"} {
+		writeChunk(e1, []byte(m), t)
+	}
+
+	// Empty node gets all chunks
+	e2 := newEnvelopeLog(e1.GetBID(), s2, nil)
+	errA, errP := syncPair(e1, e2)
+	noError(errA, t)
+	noError(errP, t)
+	noError(e2.Validate(), t)
+
+	// Only new chunks are transferred
+	for _, m := range []string{"third", "fourth"} {
+		writeChunk(e1, []byte(m), t)
+	}
+	errA, errP = syncPair(e2, e1)
+	noError(errA, t)
+	noError(errP, t)
+	noError(e2.Validate(), t)
+	if cnt := e2.GetChunksCount(); cnt != 4 {
+		t.Fatalf("Expected 4 chunks, got %v", cnt)
+	}
+	if data := readChunk(e2, 3, t); !bytes.Equal(data, []byte("fourth")) {
+		t.Fatalf("Invalid chunk content: %q", data)
+	}
+
+	// Forked log is rejected
+	s3 := localstorage.InMemory()
+	e3, err := NewLog(privKey, s3, nil)
+	noError(err, t)
+	for _, m := range []string{"first", "other", "third", "fourth", "fifth"} {
+		writeChunk(e3, []byte(m), t)
+	}
+	errA, errP = syncPair(e3, e2)
+	needError(errA, ErrSyncRejected, t)
+	needError(errP, ErrBrokenLogChain, t)
+	if cnt := e2.GetChunksCount(); cnt != 4 {
+		t.Fatalf("Expected 4 chunks, got %v", cnt)
+	}
+}
+
+func TestSyncMismatch(t *testing.T) {
+	s := localstorage.InMemory()
+
+	_, privKey1, err := ed25519.GenerateKey(rand.Reader)
+	noError(err, t)
+	_, privKey2, err := ed25519.GenerateKey(rand.Reader)
+	noError(err, t)
+
+	e1, err := NewSigned(privKey1, s, nil)
+	noError(err, t)
+	e2, err := NewSigned(privKey2, s, nil)
+	noError(err, t)
+	e3, err := NewLog(privKey1, s, nil)
+	noError(err, t)
+
+	errA, errP := syncPair(e1, e2)
+	needError(errA, ErrSyncMismatch, t)
+	needError(errP, ErrSyncMismatch, t)
+
+	// Same BID, different type
+	errA, errP = syncPair(e1, e3)
+	needError(errA, ErrSyncMismatch, t)
+	needError(errP, ErrSyncMismatch, t)
+}
+
+func TestSyncHostilePeer(t *testing.T) {
+	s := localstorage.InMemory()
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	noError(err, t)
+	e, err := NewSigned(privKey, s, nil)
+	noError(err, t)
+
+	// Peer claiming newer version and sending a huge blob
+	c1, c2 := net.Pipe()
+	go func(c1 net.Conn) {
+		utils.SerializeInt(syncProtocolVersion, c1)
+		utils.SerializeString(e.GetBID(), c1, maxSyncBIDLength)
+		utils.SerializeInt(TypeSigned, c1)
+		utils.SerializeInt(100, c1)
+		utils.DeserializeInt(c1)
+		utils.DeserializeInt(c1)
+		utils.SerializeInt(1<<40, c1)
+		utils.DeserializeInt(c1)
+		c1.Close()
+	}(c1)
+	needError(e.SynchronizeWithOtherNode(c2, false), utils.ErrBufferToLarge, t)
+
+	// Peer that never responds
+	saved := syncTimeout
+	syncTimeout = 50 * time.Millisecond
+	defer func() { syncTimeout = saved }()
+
+	c1, c2 = net.Pipe()
+	defer c1.Close()
+	needError(e.SynchronizeWithOtherNode(c2, false), ErrSyncTimeout, t)
+}
+
+func TestSyncSignedRevoked(t *testing.T) {
+	s1, s2 := localstorage.InMemory(), localstorage.InMemory()
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	noError(err, t)
+
+	e1, err := NewSigned(privKey, s1, nil)
+	noError(err, t)
+	e2, err := NewSigned(privKey, s2, nil)
+	noError(err, t)
+
+	writeChunk(e1, []byte("version 1"), t)
+	writeChunk(e2, []byte("version 1"), t)
+	noError(e1.Revoke(), t)
+
+	// Tombstone replaces the content on the other node
+	errA, errP := syncPair(e2, e1)
+	noError(errA, t)
+	noError(errP, t)
+	if r := e2.GetAttribute("revoked"); r != true {
+		t.Fatalf("Invalid revoked attribute: %v", r)
+	}
+	_, err = e2.GetChunkReader(0)
+	needError(err, ErrRevoked, t)
+
+	// Content written elsewhere can not replace the tombstone
+	s3 := localstorage.InMemory()
+	e3, err := NewSigned(privKey, s3, nil)
+	noError(err, t)
+	e3.SetVersion(100)
+	writeChunk(e3, []byte("version 100"), t)
+
+	errA, errP = syncPair(e3, e2)
+	needError(errP, ErrRevoked, t)
+	anyError(errA, t)
+	if r := e2.GetAttribute("revoked"); r != true {
+		t.Fatalf("Invalid revoked attribute: %v", r)
+	}
+}
+
+func TestSyncMultiSig(t *testing.T) {
+	s1, s2 := localstorage.InMemory(), localstorage.InMemory()
+	pubKeys, privKeys := generateSigners(2, t)
+
+	e1, err := NewMultiSig(2, pubKeys, s1, nil)
+	noError(err, t)
+	noError(e1.AddSigningKey(privKeys[0]), t)
+	noError(e1.AddSigningKey(privKeys[1]), t)
+	e1.SetVersion(2)
+	writeChunk(e1, []byte("version 2"), t)
+
+	// Read-only node receives the data
+	e2 := newEnvelopeMultiSig(e1.GetBID(), s2, nil)
+	errA, errP := syncPair(e2, e1)
+	noError(errA, t)
+	noError(errP, t)
+	noError(e2.Validate(), t)
+	if data := readChunk(e2, 0, t); !bytes.Equal(data, []byte("version 2")) {
+		t.Fatalf("Invalid chunk content: %q", data)
+	}
+	if v := e2.GetAttribute("version"); v != uint64(2) {
+		t.Fatalf("Invalid version: %v", v)
+	}
+}
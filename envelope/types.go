@@ -1,5 +1,9 @@
 package envelope
 
 const (
-	TypeHash = 1
+	TypeHash     = 1
+	TypeSigned   = 2
+	TypeLog      = 3
+	TypeExpiring = 4
+	TypeMultiSig = 5
 )
@@ -0,0 +1,146 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envelope
+
+import (
+	"context"
+	"github.com/cinode/golib/cipherfactory"
+	"github.com/cinode/golib/localstorage"
+	"runtime"
+	"sync"
+)
+
+// Storage used during validation, readers it creates can be cancelled
+// through the context and report the number of bytes read
+type validationStorage struct {
+	localstorage.Storage
+	ctx      context.Context
+	progress func(n int64)
+	read     int64 // Number of bytes read so far by all readers
+}
+
+func newValidationStorage(ctx context.Context, storage localstorage.Storage, progress func(n int64)) *validationStorage {
+	return &validationStorage{Storage: storage, ctx: ctx, progress: progress}
+}
+
+func (s *validationStorage) GetBlobReader(blobId string) (localstorage.Reader, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	r, err := s.Storage.GetBlobReader(blobId)
+	if err != nil {
+		return nil, err
+	}
+	return &validationReader{Reader: r, s: s}, nil
+}
+
+type validationReader struct {
+	localstorage.Reader
+	s *validationStorage
+}
+
+func (r *validationReader) Read(p []byte) (n int, err error) {
+	if err = r.s.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err = r.Reader.Read(p)
+	if n > 0 {
+		r.s.read += int64(n)
+		if r.s.progress != nil {
+			r.s.progress(r.s.read)
+		}
+	}
+	return n, err
+}
+
+// Result of validation of multiple envelopes
+type BulkValidationResult struct {
+	Valid   []string         // BIDs of valid envelopes in the order given, without duplicates
+	Invalid map[string]error // Validation errors by BID
+	Read    int64            // Number of bytes read during validation
+}
+
+// Validate envelopes with given BIDs using at most workers envelopes
+// validated at the same time, all CPUs are used if workers is not positive.
+// Each envelope is validated once even if its BID is given multiple times.
+//
+// The progress function, if not nil, is called with the total number of
+// bytes read so far, calls are never made concurrently. Once the context
+// is cancelled, envelopes not validated yet are reported as invalid with
+// the context error which is returned as well.
+func ValidateBulk(
+	ctx context.Context,
+	bids []string,
+	storage localstorage.Storage,
+	cf cipherfactory.Factory,
+	workers int,
+	progress func(n int64),
+) (*BulkValidationResult, error) {
+
+	cf = getCipherFactory(cf)
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	unique := make([]string, 0, len(bids))
+	seen := make(map[string]bool, len(bids))
+	for _, bid := range bids {
+		if !seen[bid] {
+			seen[bid] = true
+			unique = append(unique, bid)
+		}
+	}
+	bids = unique
+
+	result := &BulkValidationResult{Invalid: make(map[string]error)}
+	errs := make([]error, len(bids))
+
+	var lock sync.Mutex // Protects the progress
+	validate := func(bid string) error {
+		e, err := Open(bid, storage, cf)
+		if err != nil {
+			return err
+		}
+		var last int64
+		return e.ValidateContext(ctx, func(n int64) {
+			lock.Lock()
+			defer lock.Unlock()
+			result.Read += n - last
+			last = n
+			if progress != nil {
+				progress(result.Read)
+			}
+		})
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				if errs[idx] = ctx.Err(); errs[idx] == nil {
+					errs[idx] = validate(bids[idx])
+				}
+			}
+		}()
+	}
+	for idx := range bids {
+		indexes <- idx
+	}
+	close(indexes)
+	wg.Wait()
+
+	for idx, bid := range bids {
+		if errs[idx] != nil {
+			result.Invalid[bid] = errs[idx]
+		} else {
+			result.Valid = append(result.Valid, bid)
+		}
+	}
+
+	return result, ctx.Err()
+}
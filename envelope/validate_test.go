@@ -0,0 +1,146 @@
+// Copyright 2014 The Cinode Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/cinode/golib/localstorage"
+	"io/ioutil"
+	"testing"
+)
+
+// Create hash envelope with given content, returns its BID
+func createHashEnvelope(s localstorage.Storage, data []byte, t *testing.T) string {
+	e, err := New(TypeHash, s, nil)
+	noError(err, t)
+	writeChunk(e, data, t)
+	return e.GetBID()
+}
+
+func TestValidateContext(t *testing.T) {
+	s := localstorage.InMemory()
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	bid := createHashEnvelope(s, data, t)
+
+	r, err := s.GetBlobReader(bid)
+	noError(err, t)
+	blob, err := ioutil.ReadAll(r)
+	noError(err, t)
+	r.Close()
+
+	e, err := Open(bid, s, nil)
+	noError(err, t)
+
+	var last int64
+	noError(e.ValidateContext(context.Background(), func(n int64) {
+		if n <= last {
+			t.Fatalf("Progress must grow, got %v after %v", n, last)
+		}
+		last = n
+	}), t)
+	if last != int64(len(blob)) {
+		t.Fatalf("Invalid progress, expected %v, got %v", len(blob), last)
+	}
+
+	// Cancel in the middle of validation
+	ctx, cancel := context.WithCancel(context.Background())
+	needError(e.ValidateContext(ctx, func(n int64) {
+		if n > int64(len(blob)/2) {
+			cancel()
+		}
+	}), context.Canceled, t)
+
+	// Already cancelled context
+	needError(e.ValidateContext(ctx, nil), context.Canceled, t)
+}
+
+func TestValidateContextLog(t *testing.T) {
+	s := localstorage.InMemory()
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	noError(err, t)
+	e, err := NewLog(privKey, s, nil)
+	noError(err, t)
+	for i := 0; i < 10; i++ {
+		writeChunk(e, bytes.Repeat([]byte{byte(i)}, 1000), t)
+	}
+
+	var last int64
+	noError(e.ValidateContext(context.Background(), func(n int64) { last = n }), t)
+	if last < 10*1000 {
+		t.Fatalf("Invalid progress: %v", last)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	needError(e.ValidateContext(ctx, func(n int64) {
+		if n > 5*1000 {
+			cancel()
+		}
+	}), context.Canceled, t)
+}
+
+func TestValidateBulk(t *testing.T) {
+	s := localstorage.InMemory()
+
+	var bids []string
+	for i := 0; i < 20; i++ {
+		bids = append(bids, createHashEnvelope(s, bytes.Repeat([]byte{byte(i)}, 1000+i), t))
+	}
+
+	// Corrupt one of envelopes, one is missing
+	modifyBlob(s, bids[3], func(data []byte) []byte {
+		data[len(data)-1] ^= 1
+		return data
+	}, t)
+	missing := createHashEnvelope(localstorage.InMemory(), []byte("missing"), t)
+	bids = append(bids, missing)
+
+	var last int64
+	result, err := ValidateBulk(context.Background(), bids, s, nil, 4, func(n int64) {
+		if n <= last {
+			t.Errorf("Progress must grow, got %v after %v", n, last)
+		}
+		last = n
+	})
+	noError(err, t)
+
+	if len(result.Valid) != 19 || len(result.Invalid) != 2 {
+		t.Fatalf("Invalid results: %v valid, %v invalid", len(result.Valid), len(result.Invalid))
+	}
+	for i, bid := range result.Valid {
+		if i >= 3 && bid != bids[i+1] || i < 3 && bid != bids[i] {
+			t.Fatal("Valid BIDs must keep the order")
+		}
+	}
+	needError(result.Invalid[bids[3]], ErrInvalidHashBID, t)
+	needError(result.Invalid[missing], localstorage.ErrNoSuchBlob, t)
+	if result.Read == 0 || result.Read != last {
+		t.Fatalf("Invalid number of bytes read: %v, last progress: %v", result.Read, last)
+	}
+
+	// Cancelled validation
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err = ValidateBulk(ctx, bids, s, nil, 0, nil)
+	needError(err, context.Canceled, t)
+	if len(result.Valid) != 0 || len(result.Invalid) != len(bids) {
+		t.Fatalf("Invalid results: %v valid, %v invalid", len(result.Valid), len(result.Invalid))
+	}
+
+	// Duplicated BIDs are validated and reported once
+	single, err := ValidateBulk(context.Background(), bids[:2], s, nil, 2, nil)
+	noError(err, t)
+	result, err = ValidateBulk(context.Background(), []string{bids[0], bids[1], bids[0], bids[1]}, s, nil, 2, nil)
+	noError(err, t)
+	if len(result.Valid) != 2 || result.Valid[0] != bids[0] || result.Valid[1] != bids[1] {
+		t.Fatalf("Invalid valid BIDs: %v", result.Valid)
+	}
+	if result.Read != single.Read {
+		t.Fatalf("Duplicated envelopes validated again, read %v bytes instead of %v", result.Read, single.Read)
+	}
+}
@@ -8,4 +8,5 @@ var (
 	ErrNoSuchBlob           = errors.New("blob with such ID could not be found")
 	ErrBlobAlreadyFinalized = errors.New("this blob has already been finalized")
 	ErrInvalidBlobID        = errors.New("invalid blob ID")
+	ErrNotSupported         = errors.New("operation not supported by the storage")
 )
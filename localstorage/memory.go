@@ -2,7 +2,6 @@ package localstorage
 
 import (
 	"bytes"
-	"io/ioutil"
 )
 
 // memory represents simple blob storage holding data inside it's memory
@@ -16,13 +15,38 @@ func (m *memory) GetBlobReader(blobID string) (reader Reader, err error) {
 		return nil, ErrNoSuchBlob
 	}
 
-	return ioutil.NopCloser(bytes.NewBuffer(buff)), nil
+	return memoryReader{bytes.NewReader(buff)}, nil
+}
+
+// memoryReader gives access to blob data, it can seek within the blob
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (r memoryReader) Close() error {
+	return nil
 }
 
 func (m *memory) GetBlobWriter() (writer Writer, err error) {
 	return &memoryWriter{m: m}, nil
 }
 
+func (m *memory) ListBlobs() (blobIds []string, err error) {
+	blobIds = make([]string, 0, len(m.blobs))
+	for blobID := range m.blobs {
+		blobIds = append(blobIds, blobID)
+	}
+	return blobIds, nil
+}
+
+func (m *memory) DeleteBlob(blobID string) error {
+	if _, ok := m.blobs[blobID]; !ok {
+		return ErrNoSuchBlob
+	}
+	delete(m.blobs, blobID)
+	return nil
+}
+
 type memoryWriter struct {
 	b bytes.Buffer // Buffer holding part of the data written so far
 	m *memory      // Parent memory storage object
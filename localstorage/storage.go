@@ -13,3 +13,17 @@ type Storage interface {
 	// GetBlobWriter creates a writer for new blob
 	GetBlobWriter() (writer Writer, err error)
 }
+
+// Lister is an optional interface of storages able to enumerate blobs
+type Lister interface {
+
+	// ListBlobs returns ids of all blobs in the storage
+	ListBlobs() (blobIds []string, err error)
+}
+
+// Deleter is an optional interface of storages able to remove blobs
+type Deleter interface {
+
+	// DeleteBlob removes the blob from the storage or fails with an error
+	DeleteBlob(blobId string) error
+}
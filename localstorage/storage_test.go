@@ -118,6 +118,44 @@ func genericStorageTest(s Storage, t *testing.T) {
 	if bytes.Compare(buff, testContent) != 0 {
 		t.Fatalf("Invalid data read from the blob")
 	}
+
+	// Listing blobs
+	lister, ok := s.(Lister)
+	if !ok {
+		return
+	}
+	blobIds, err := lister.ListBlobs()
+	if err != nil {
+		t.Fatalf("Couldn't list blobs: %v", err)
+	}
+	if len(blobIds) != 1 || blobIds[0] != testBID {
+		t.Fatalf("Invalid list of blobs: %v", blobIds)
+	}
+
+	// Removing blobs
+	deleter, ok := s.(Deleter)
+	if !ok {
+		return
+	}
+	err = deleter.DeleteBlob(testBID)
+	if err != nil {
+		t.Fatalf("Couldn't delete blob: %v", err)
+	}
+	rdr, err = s.GetBlobReader(testBID)
+	if err != ErrNoSuchBlob {
+		t.Fatalf("Invalid error while reading deleted blob: %v", err)
+	}
+	err = deleter.DeleteBlob(testBID)
+	if err != ErrNoSuchBlob {
+		t.Fatalf("Invalid error while deleting blob twice: %v", err)
+	}
+	blobIds, err = lister.ListBlobs()
+	if err != nil {
+		t.Fatalf("Couldn't list blobs: %v", err)
+	}
+	if len(blobIds) != 0 {
+		t.Fatalf("Invalid list of blobs: %v", blobIds)
+	}
 }
 
 func TestMemoryBlob(t *testing.T) {